@@ -0,0 +1,53 @@
+/*
+Copyright © 2020 Syncier GmbH <info@syncier.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/syncier/helmt/pkg/helmt"
+)
+
+const jsonFlag = "json"
+
+var imagesCmd = &cobra.Command{
+	Use:   "images <filename>",
+	Short: "Prints the container images used by the rendered chart",
+	Long: `Prints the container images used by the rendered chart.
+The image inventory is written when rendering a chart with
+
+postProcess:
+  imageInventory: true
+`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filename := "helm-chart.yaml"
+
+		if len(args) == 1 {
+			filename = args[0]
+		}
+
+		asJSON, err := cmd.Flags().GetBool(jsonFlag)
+		if err != nil {
+			return err
+		}
+		return helmt.RedactError(helmt.PrintImages(filename, asJSON))
+	},
+}
+
+func init() {
+	imagesCmd.Flags().Bool(jsonFlag, false, "print the image inventory including the usages of every image as json")
+	rootCmd.AddCommand(imagesCmd)
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2020 Syncier GmbH <info@syncier.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/syncier/helmt/pkg/helmt"
+)
+
+const (
+	passwordStdinFlag  = "password-stdin"
+	registryConfigFlag = "registry-config"
+)
+
+var loginCmd = &cobra.Command{
+	Use:   "login <registry>",
+	Short: "Stores the credentials of an OCI registry",
+	Long: `Verifies the credentials of an OCI registry and stores them in the registry config of helm.
+They are used by helmt and helm for oci:// repositories of this registry.
+
+helmt login registry.example.com --username robot --password-stdin < token.txt
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		password := viper.GetString(passwordFlag)
+		passwordStdin, err := cmd.Flags().GetBool(passwordStdinFlag)
+		if err != nil {
+			return err
+		}
+		if passwordStdin {
+			input, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			password = strings.TrimRight(string(input), "\r\n")
+		}
+
+		configFile, err := cmd.Flags().GetString(registryConfigFlag)
+		if err != nil {
+			return err
+		}
+		if configFile == "" {
+			configFile = helmt.HelmRegistryConfigFile()
+		}
+
+		err = helmt.Login(cmd.Context(), args[0], viper.GetString(usernameFlag), password, configFile)
+		if err != nil {
+			return helmt.RedactError(err)
+		}
+		fmt.Printf("Login to %s succeeded, credentials stored in %s\n", args[0], configFile)
+		return nil
+	},
+}
+
+func init() {
+	loginCmd.Flags().Bool(passwordStdinFlag, false, "read the password from stdin")
+	loginCmd.Flags().String(registryConfigFlag, "", "registry config to store the credentials in (default is the registry config of helm)")
+	rootCmd.AddCommand(loginCmd)
+}
@@ -16,8 +16,13 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
@@ -30,6 +35,8 @@ const (
 	cleanFlag    = "clean"
 	usernameFlag = "username"
 	passwordFlag = "password"
+
+	projectConfigFile = ".helmt.yaml"
 )
 
 var rootCmd = &cobra.Command{
@@ -42,17 +49,69 @@ chart: jenkins
 version: 2.0.0
 repository: https://kubernetes-charts.storage.googleapis.com
 namespace: jenkins
+createNamespace: false
+namespaceLabels:
+  team: platform
+namespaceAnnotations:
+  owner: platform@example.com
 values:
   - values1.yaml
-  - values2.yaml
+  - values2.sops.yaml
 skipCRDs: false
 postProcess:
   generateKustomization: false
+  kustomization:
+    namespace: jenkins
+    commonLabels:
+      app: jenkins
+    perDirectory: false
+  umbrellaKustomization: false
+  imageInventory: false
+  imageRewrites:
+    - from: docker.io/
+      to: mirror.local/dockerhub/
+  pinImageDigests: false
+  validate:
+    enabled: false
+    schemaDirs:
+      - schemas
+  externalizeSecrets:
+    mode: encrypt
+    recipients:
+      - age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p
+  secretScan:
+    enabled: false
+    mode: fail
+  policies:
+    enabled: false
+    format: text
+    allowedRegistries:
+      - mirror.local/
+    rules:
+      latest-tag: error
+  separateCRDs: false
+  chartFiles:
+    - values.yaml
 apiVersions:
   - "app/v1"
-
-namespace, values, skipCRDs apiVersions and postProcess are optional
+kubeVersion: 1.21.0
+capabilities: prod-cluster
+caFile: certs/ca.pem
+certFile: certs/client.pem
+keyFile: certs/client-key.pem
+insecureSkipTLSVerify: false
+passCredentials: false
+verify:
+  mode: enforce
+  keyring: keys/pubring.gpg
+  publicKey: keys/cosign.pub
+digest: sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855
+
+namespace, createNamespace, namespaceLabels, namespaceAnnotations, values, skipCRDs, apiVersions, kubeVersion,
+capabilities, caFile, certFile, keyFile, insecureSkipTLSVerify, passCredentials, verify, digest and postProcess
+are optional
 `,
+	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		filename := "helm-chart.yaml"
 
@@ -63,15 +122,32 @@ namespace, values, skipCRDs apiVersions and postProcess are optional
 
 		username := viper.GetString(usernameFlag)
 		password := viper.GetString(passwordFlag)
-		return helmt.HelmTemplate(filename, username, password)
+		return helmt.RedactError(helmt.HelmTemplate(cmd.Context(), filename, username, password))
 	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// SIGINT and SIGTERM cancel the running command, a second signal terminates helmt immediately.
 func Execute(version string) error {
 	rootCmd.Version = version
-	return rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// a second signal exits immediately, without leaving decrypted values behind
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		stop()
+		<-signals
+		helmt.RemoveTemporaryDirectories()
+		os.Exit(130)
+	}()
+	err := rootCmd.ExecuteContext(ctx)
+	if ctx.Err() != nil {
+		os.Exit(130)
+	}
+	return err
 }
 
 func init() {
@@ -81,6 +157,10 @@ func init() {
 	rootCmd.PersistentFlags().Bool(cleanFlag, false, "deprecated flag - cleaning is done by default")
 	rootCmd.PersistentFlags().StringP(usernameFlag, "u", "", "optional username for chart repository")
 	rootCmd.PersistentFlags().StringP(passwordFlag, "p", "", "optional password for chart repository")
+	rootCmd.PersistentFlags().Duration(helmt.FetchTimeoutFlag, 0, "timeout for downloading and verifying the chart, 0 disables it")
+	rootCmd.PersistentFlags().Duration(helmt.TemplateTimeoutFlag, 0, "timeout for helm template, 0 disables it")
+	rootCmd.PersistentFlags().Int(helmt.RetriesFlag, 3, "number of retries of failed requests to chart repositories and registries")
+	rootCmd.PersistentFlags().String(helmt.AgeKeyFileFlag, "", "age identity file to decrypt encrypted values (default is $SOPS_AGE_KEY_FILE or ~/.config/sops/age/keys.txt)")
 
 	err := viper.BindPFlags(rootCmd.PersistentFlags())
 	if err != nil {
@@ -107,10 +187,36 @@ func initConfig() {
 	}
 
 	viper.SetEnvPrefix("helmt")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
+		// read it again to resolve relative files against its directory, before the project config is merged
+		if err := helmt.MergeConfigFile(viper.ConfigFileUsed()); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
+
+	if !viper.IsSet("config") {
+		mergeProjectConfig()
+	}
+}
+
+// mergeProjectConfig merges .helmt.yaml of the working directory into the config of the home directory.
+func mergeProjectConfig() {
+	projectConfig, err := filepath.Abs(projectConfigFile)
+	if err != nil {
+		return
+	}
+	if _, err := os.Stat(projectConfig); err != nil || projectConfig == viper.ConfigFileUsed() {
+		return
+	}
+	if err := helmt.MergeConfigFile(projectConfig); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Using project config file:", projectConfig)
 }
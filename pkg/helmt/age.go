@@ -0,0 +1,106 @@
+package helmt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+const ageIntro = "age-encryption.org/v1\n"
+
+// parseAgeRecipient decodes an age1... public key.
+func parseAgeRecipient(recipient string) (*age.X25519Recipient, error) {
+	parsed, err := age.ParseX25519Recipient(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age recipient %s", recipient)
+	}
+	return parsed, nil
+}
+
+// parseAgeIdentities reads the AGE-SECRET-KEY-1... lines of an identity file, comments and empty lines are ignored.
+func parseAgeIdentities(content []byte) ([]age.Identity, error) {
+	var identities []age.Identity
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		identity, err := age.ParseX25519Identity(line)
+		if err != nil {
+			return nil, errors.New("invalid age identity")
+		}
+		identities = append(identities, identity)
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("no age identity found")
+	}
+	return identities, nil
+}
+
+// ageEncrypt encrypts plaintext for the X25519 recipients and returns an armored age file.
+func ageEncrypt(plaintext []byte, recipients ...string) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no age recipient given")
+	}
+	parsed := make([]age.Recipient, 0, len(recipients))
+	for _, recipient := range recipients {
+		r, err := parseAgeRecipient(recipient)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, r)
+	}
+
+	encrypted := &bytes.Buffer{}
+	armored := armor.NewWriter(encrypted)
+	writer, err := age.Encrypt(armored, parsed...)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = armored.Close()
+	if err != nil {
+		return nil, err
+	}
+	return append(encrypted.Bytes(), '\n'), nil
+}
+
+// ageDecrypt decrypts an armored or binary age file with one of the identities.
+func ageDecrypt(ciphertext []byte, identities []age.Identity) ([]byte, error) {
+	var source io.Reader = bytes.NewReader(ciphertext)
+	if isAgeArmored(ciphertext) {
+		source = armor.NewReader(bytes.NewReader(bytes.TrimSpace(ciphertext)))
+	}
+	reader, err := age.Decrypt(source, identities...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, errors.New("no matching age identity found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+func isAgeArmored(content []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(content), []byte(armor.Header))
+}
+
+func isAgeEncrypted(content []byte) bool {
+	return isAgeArmored(content) || bytes.HasPrefix(content, []byte(ageIntro))
+}
@@ -0,0 +1,88 @@
+package helmt
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAgeRecipient = "age190uzqvjyhf0l4umjj6sx6p75hwtu4pplk3eufv20u5nlqrxgdq9qeh5pav"
+
+func readTestAgeIdentities(t *testing.T) []age.Identity {
+	content, err := ioutil.ReadFile("testdata/age/key.txt")
+	require.NoError(t, err)
+	identities, err := parseAgeIdentities(content)
+	require.NoError(t, err)
+	return identities
+}
+
+func Test_parseAgeIdentities(t *testing.T) {
+	identities := readTestAgeIdentities(t)
+	require.Len(t, identities, 1)
+	assert.Equal(t, testAgeRecipient, identities[0].(*age.X25519Identity).Recipient().String())
+
+	_, err := parseAgeIdentities([]byte("# no keys\n"))
+	assert.EqualError(t, err, "no age identity found")
+	_, err = parseAgeIdentities([]byte(testAgeRecipient))
+	assert.EqualError(t, err, "invalid age identity")
+}
+
+func Test_parseAgeRecipient(t *testing.T) {
+	recipient, err := parseAgeRecipient(testAgeRecipient)
+	assert.NoError(t, err)
+	assert.Equal(t, testAgeRecipient, recipient.String())
+
+	_, err = parseAgeRecipient("age190uzqvjyhf0l4umjj6sx6p75hwtu4pplk3eufv20u5nlqrxgdq9qeh5paw")
+	assert.EqualError(t, err, "invalid age recipient age190uzqvjyhf0l4umjj6sx6p75hwtu4pplk3eufv20u5nlqrxgdq9qeh5paw")
+}
+
+func Test_ageDecrypt(t *testing.T) {
+	identities := readTestAgeIdentities(t)
+	for _, file := range []string{"testdata/age/values.yaml.age", "testdata/age/values.bin.age"} {
+		t.Run(file, func(t *testing.T) {
+			content, err := ioutil.ReadFile(file)
+			require.NoError(t, err)
+			assert.True(t, isAgeEncrypted(content))
+			plaintext, err := ageDecrypt(content, identities)
+			assert.NoError(t, err)
+			assert.Equal(t, "replicaCount: 2\nadminPassword: hunter22\n", string(plaintext))
+		})
+	}
+}
+
+func Test_ageEncrypt(t *testing.T) {
+	identities := readTestAgeIdentities(t)
+	tests := []struct {
+		name      string
+		plaintext string
+	}{
+		{name: "empty"},
+		{name: "small", plaintext: "password: hunter22\n"},
+		{name: "multiple chunks", plaintext: strings.Repeat("0123456789abcdef", 10000)},
+		{name: "exact chunk", plaintext: strings.Repeat("x", 64*1024)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted, err := ageEncrypt([]byte(tt.plaintext), testAgeRecipient)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(encrypted), armor.Header+"\n"))
+			assert.False(t, strings.Contains(string(encrypted), "hunter22"))
+
+			decrypted, err := ageDecrypt(encrypted, identities)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.plaintext, string(decrypted))
+		})
+	}
+
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	encrypted, err := ageEncrypt([]byte("secret"), testAgeRecipient)
+	require.NoError(t, err)
+	_, err = ageDecrypt(encrypted, []age.Identity{other})
+	assert.EqualError(t, err, "no matching age identity found")
+}
@@ -0,0 +1,72 @@
+package helmt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+const capabilitiesKey = "capabilities"
+
+// CapabilitiesProfile describes the kubernetes version and APIs of a cluster, it is configured in the helmt config file.
+type CapabilitiesProfile struct {
+	KubeVersion string   `mapstructure:"kubeVersion"`
+	ApiVersions []string `mapstructure:"apiVersions"`
+	// ApiVersionsFile contains the output of kubectl api-versions, relative paths are resolved against the config file.
+	ApiVersionsFile string `mapstructure:"apiVersionsFile"`
+}
+
+// expandCapabilities applies the capabilities profile referenced by the chart.
+// The api versions of the profile are added to the ones of the chart, a kubeVersion of the chart takes precedence.
+func expandCapabilities(chart *HelmChart) error {
+	if chart.Capabilities == "" {
+		return nil
+	}
+	profiles := map[string]CapabilitiesProfile{}
+	err := viper.UnmarshalKey(capabilitiesKey, &profiles)
+	if err != nil {
+		return fmt.Errorf("invalid capabilities in config: %v", err)
+	}
+	// viper keys are case insensitive
+	profile, ok := profiles[strings.ToLower(chart.Capabilities)]
+	if !ok {
+		return fmt.Errorf("capabilities profile '%s' not found in config", chart.Capabilities)
+	}
+
+	apiVersions := profile.ApiVersions
+	if profile.ApiVersionsFile != "" {
+		fromFile, err := readApiVersions(profile.ApiVersionsFile)
+		if err != nil {
+			return fmt.Errorf("failed to read api versions of capabilities profile '%s': %v", chart.Capabilities, err)
+		}
+		apiVersions = append(apiVersions, fromFile...)
+	}
+
+	chart.ApiVersions = append(chart.ApiVersions, apiVersions...)
+	if chart.KubeVersion == "" {
+		chart.KubeVersion = profile.KubeVersion
+	}
+	return nil
+}
+
+// readApiVersions reads a file written by kubectl api-versions, one api version per line.
+func readApiVersions(filename string) ([]string, error) {
+	content, err := afero.ReadFile(fs, filename)
+	if err != nil {
+		return nil, err
+	}
+	var apiVersions []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		apiVersions = append(apiVersions, line)
+	}
+	return apiVersions, scanner.Err()
+}
@@ -0,0 +1,72 @@
+package helmt
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_expandCapabilities(t *testing.T) {
+	fs = afero.NewOsFs()
+	require.NoError(t, MergeConfigFile("testdata/helmt-config.yaml"))
+	defer viper.Reset()
+
+	tests := []struct {
+		name     string
+		chart    HelmChart
+		expected HelmChart
+		wantErr  bool
+	}{
+		{
+			name:     "no profile",
+			chart:    HelmChart{ApiVersions: []string{"apps/v1"}},
+			expected: HelmChart{ApiVersions: []string{"apps/v1"}},
+		},
+		{
+			name:  "profile with api versions file",
+			chart: HelmChart{Capabilities: "prod-cluster", ApiVersions: []string{"cert-manager.io/v1"}},
+			expected: HelmChart{
+				Capabilities: "prod-cluster",
+				ApiVersions:  []string{"cert-manager.io/v1", "monitoring.coreos.com/v1", "apps/v1", "networking.k8s.io/v1", "v1"},
+				KubeVersion:  "1.21.5",
+			},
+		},
+		{
+			name:     "kube version of the chart takes precedence",
+			chart:    HelmChart{Capabilities: "dev-cluster", KubeVersion: "1.20.0"},
+			expected: HelmChart{Capabilities: "dev-cluster", KubeVersion: "1.20.0"},
+		},
+		{
+			name:    "unknown profile",
+			chart:   HelmChart{Capabilities: "staging-cluster"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chart := tt.chart
+			err := expandCapabilities(&chart)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, chart)
+		})
+	}
+}
+
+func Test_readApiVersions(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/config/api-versions.txt", []byte("# kubectl api-versions\napps/v1\n\nv1\n"), 0644))
+
+	apiVersions, err := readApiVersions("/config/api-versions.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"apps/v1", "v1"}, apiVersions)
+
+	_, err = readApiVersions("/config/missing.txt")
+	assert.Error(t, err)
+}
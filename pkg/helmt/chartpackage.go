@@ -0,0 +1,72 @@
+package helmt
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+var errChartFileNotFound = errors.New("not found")
+
+// readChartFile reads a file of the chart from the chart package, name is relative to the chart directory.
+func readChartFile(chartPackage, name string) ([]byte, error) {
+	file, err := fs.Open(chartPackage)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chart package %s: %v", chartPackage, err)
+	}
+	archive := tar.NewReader(compressed)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s %w in chart package %s", name, errChartFileNotFound, chartPackage)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid chart package %s: %v", chartPackage, err)
+		}
+		// the files of the chart are in a directory named like the chart, files of subcharts are ignored
+		parts := strings.SplitN(strings.TrimPrefix(header.Name, "./"), "/", 2)
+		if header.Typeflag == tar.TypeReg && len(parts) == 2 && parts[1] == name {
+			return ioutil.ReadAll(archive)
+		}
+	}
+}
+
+// extractChartFilesCommand copies the files of the chart package into the rendered chart, files the chart does not
+// contain are skipped.
+func extractChartFilesCommand(chartPackage, rendered string, names []string) error {
+	for _, name := range names {
+		content, err := readChartFile(chartPackage, name)
+		if errors.Is(err, errChartFileNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = afero.WriteFile(fs, filepath.Join(rendered, name), content, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeChartMetadata writes the Chart.yaml of the chart package into the rendered chart.
+func writeChartMetadata(chartPackage, rendered string) error {
+	content, err := readChartFile(chartPackage, "Chart.yaml")
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, filepath.Join(rendered, "Chart.yaml"), content, 0644)
+}
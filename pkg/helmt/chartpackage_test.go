@@ -0,0 +1,91 @@
+package helmt
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestChartPackage returns a chart package with the given files, names are relative to the chart directory.
+// The package is not compressed to keep its digest independent of the compression implementation.
+func newTestChartPackage(t *testing.T, chart string, files map[string]string) []byte {
+	content := &bytes.Buffer{}
+	compressed, err := gzip.NewWriterLevel(content, gzip.NoCompression)
+	require.NoError(t, err)
+	archive := tar.NewWriter(compressed)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		require.NoError(t, archive.WriteHeader(&tar.Header{Name: chart + "/" + name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}))
+		_, err := archive.Write([]byte(files[name]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.Close())
+	require.NoError(t, compressed.Close())
+	return content.Bytes()
+}
+
+func Test_readChartFile(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/temp/helmt-123/jenkins-2.0.0.tgz", newTestChartPackage(t, "jenkins", map[string]string{
+		"charts/agent/Chart.yaml": "name: agent",
+		"Chart.yaml":              "name: jenkins",
+		"values.yaml":             "replicas: 1",
+	}), os.ModePerm))
+	require.NoError(t, afero.WriteFile(fs, "/temp/helmt-123/invalid.tgz", []byte("chart"), os.ModePerm))
+
+	content, err := readChartFile("/temp/helmt-123/jenkins-2.0.0.tgz", "Chart.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "name: jenkins", string(content))
+
+	content, err = readChartFile("/temp/helmt-123/jenkins-2.0.0.tgz", "charts/agent/Chart.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "name: agent", string(content))
+
+	_, err = readChartFile("/temp/helmt-123/jenkins-2.0.0.tgz", "README.md")
+	assert.EqualError(t, err, "README.md not found in chart package /temp/helmt-123/jenkins-2.0.0.tgz")
+
+	_, err = readChartFile("/temp/helmt-123/invalid.tgz", "Chart.yaml")
+	assert.EqualError(t, err, "invalid chart package /temp/helmt-123/invalid.tgz: unexpected EOF")
+}
+
+func Test_writeChartMetadata(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/temp/helmt-123/jenkins-2.0.0.tgz", newTestChartPackage(t, "jenkins", map[string]string{
+		"Chart.yaml": "apiVersion: v2\nname: jenkins\nversion: 2.0.0\n",
+	}), os.ModePerm))
+
+	require.NoError(t, writeChartMetadata("/temp/helmt-123/jenkins-2.0.0.tgz", "/temp/helmt-123/jenkins"))
+	assert.Equal(t, "apiVersion: v2\nname: jenkins\nversion: 2.0.0", ReadFileAsString(t, "/temp/helmt-123/jenkins/Chart.yaml"))
+}
+
+func Test_extractChartFilesCommand(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/temp/helmt-123/jenkins-2.0.0.tgz", newTestChartPackage(t, "jenkins", map[string]string{
+		"Chart.yaml":               "name: jenkins",
+		"README.md":                "# Jenkins",
+		"values.yaml":              "replicas: 1",
+		"charts/agent/values.yaml": "replicas: 2",
+	}), os.ModePerm))
+
+	err := extractChartFilesCommand("/temp/helmt-123/jenkins-2.0.0.tgz", "/temp/helmt-123/jenkins", []string{"values.yaml", "README.md", "values.schema.json"})
+	require.NoError(t, err)
+	assert.Equal(t, "replicas: 1", ReadFileAsString(t, "/temp/helmt-123/jenkins/values.yaml"))
+	assert.Equal(t, "# Jenkins", ReadFileAsString(t, "/temp/helmt-123/jenkins/README.md"))
+	exists, err := afero.Exists(fs, "/temp/helmt-123/jenkins/values.schema.json")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	err = extractChartFilesCommand("/temp/helmt-123/missing.tgz", "/temp/helmt-123/jenkins", []string{"values.yaml"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,328 @@
+package helmt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v2"
+)
+
+var repositoryClient = http.DefaultClient
+
+type repositoryIndex struct {
+	Entries map[string][]repositoryIndexEntry `yaml:"entries"`
+}
+
+type repositoryIndexEntry struct {
+	Version string   `yaml:"version"`
+	URLs    []string `yaml:"urls"`
+}
+
+// downloadChart looks up the chart in the index.yaml of the HTTP repository and downloads it into tmpDir.
+// With provenance, the provenance file is downloaded as well if the repository provides one.
+func downloadChart(ctx context.Context, tmpDir, repository, chart, version string, config Repository, provenance bool) (string, error) {
+	client, err := httpClient(config, repositoryClient)
+	if err != nil {
+		return "", err
+	}
+
+	indexURL := strings.TrimSuffix(repository, "/") + "/index.yaml"
+	content, err := repositoryGet(ctx, client, indexURL, config, true)
+	if err != nil {
+		return "", fmt.Errorf("failed to read index of repository %s: %v", repository, err)
+	}
+	index := repositoryIndex{}
+	err = yaml.Unmarshal(content, &index)
+	if err != nil {
+		return "", fmt.Errorf("invalid index of repository %s: %v", repository, err)
+	}
+
+	versions := make([]string, 0, len(index.Entries[chart]))
+	for _, candidate := range index.Entries[chart] {
+		versions = append(versions, candidate.Version)
+	}
+	selected, found := selectVersion(versions, version)
+	var entry *repositoryIndexEntry
+	for i := range index.Entries[chart] {
+		if found && index.Entries[chart][i].Version == selected {
+			entry = &index.Entries[chart][i]
+			break
+		}
+	}
+	if entry == nil {
+		return "", fmt.Errorf("chart %s version %s not found in repository %s", chart, version, repository)
+	}
+	if len(entry.URLs) == 0 {
+		return "", fmt.Errorf("no download URL for chart %s version %s in repository %s", chart, version, repository)
+	}
+	chartURL, err := resolveChartURL(repository, entry.URLs[0])
+	if err != nil {
+		return "", err
+	}
+	// the name is kept as provenance files refer to it, but it must not leave tmpDir
+	chartFile := path.Base(chartURL.Path)
+	if chartFile == "." || chartFile == ".." || chartFile == "/" || strings.ContainsAny(chartFile, `/\`) {
+		return "", fmt.Errorf("invalid download URL %s of chart %s version %s", chartURL.Redacted(), chart, version)
+	}
+
+	// like helm, credentials are only passed to the host of the repository unless passCredentials is set
+	withCredentials := config.PassCredentials || sameHost(repository, chartURL.String())
+	content, err = repositoryGet(ctx, client, chartURL.String(), config, withCredentials)
+	if err != nil {
+		return "", fmt.Errorf("failed to download chart %s version %s: %v", chart, version, err)
+	}
+	err = afero.WriteFile(fs, filepath.Join(tmpDir, chartFile), content, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	if provenance {
+		provenanceURL := *chartURL
+		provenanceURL.Path += ".prov"
+		if provenanceURL.RawPath != "" {
+			provenanceURL.RawPath += ".prov"
+		}
+		content, err = repositoryGet(ctx, client, provenanceURL.String(), config, withCredentials)
+		var statusError *httpStatusError
+		if errors.As(err, &statusError) && statusError.StatusCode == http.StatusNotFound {
+			// an unsigned chart is reported by the verification
+			return chartFile, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to download provenance file of chart %s version %s: %v", chart, version, err)
+		}
+		err = afero.WriteFile(fs, filepath.Join(tmpDir, chartFile+".prov"), content, 0644)
+		if err != nil {
+			return "", err
+		}
+	}
+	return chartFile, nil
+}
+
+// resolveChartURL resolves URLs of the index relative to the repository URL.
+func resolveChartURL(repository, chartURL string) (*url.URL, error) {
+	base, err := url.Parse(strings.TrimSuffix(repository, "/") + "/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL %s: %v", repository, err)
+	}
+	reference, err := url.Parse(chartURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chart URL %s: %v", chartURL, err)
+	}
+	return base.ResolveReference(reference), nil
+}
+
+func sameHost(first, second string) bool {
+	firstURL, err := url.Parse(first)
+	if err != nil {
+		return false
+	}
+	secondURL, err := url.Parse(second)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(firstURL.Host, secondURL.Host)
+}
+
+// repositoryGet reads the content of requestURL, temporary failures are retried.
+func repositoryGet(ctx context.Context, client *http.Client, requestURL string, config Repository, withCredentials bool) ([]byte, error) {
+	var content []byte
+	err := retry(ctx, func() error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+		if err != nil {
+			return err
+		}
+		if withCredentials && (config.Username != "" || config.Password != "") {
+			request.SetBasicAuth(config.Username, config.Password)
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = response.Body.Close() }()
+		if response.StatusCode != http.StatusOK {
+			return &httpStatusError{URL: requestURL, StatusCode: response.StatusCode}
+		}
+		content, err = ioutil.ReadAll(response.Body)
+		return err
+	})
+	return content, err
+}
+
+// pullChart downloads the chart layer of the OCI artifact of the chart into tmpDir.
+func pullChart(ctx context.Context, tmpDir, repository, chart, version string, config Repository) (string, error) {
+	ref := ociReference(repository, chart)
+	credentials, err := ociCredentials(config)
+	if err != nil {
+		return "", err
+	}
+
+	tag, err := resolveOCITag(ctx, ref, version, credentials)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve chart %s version %s: %v", chart, version, err)
+	}
+	content, err := registryContent(ctx, fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repository, tag), ref, credentials)
+	if err != nil {
+		return "", fmt.Errorf("failed to read manifest of chart %s version %s: %v", chart, version, err)
+	}
+	manifest := ociManifest{}
+	err = json.Unmarshal(content, &manifest)
+	if err != nil {
+		return "", fmt.Errorf("invalid manifest of chart %s version %s: %v", chart, version, err)
+	}
+
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != helmChartLayerType {
+			continue
+		}
+		content, err = registryContent(ctx, fmt.Sprintf("https://%s/v2/%s/blobs/%s", ref.Registry, ref.Repository, layer.Digest), ref, credentials)
+		if err != nil {
+			return "", fmt.Errorf("failed to download chart %s version %s: %v", chart, version, err)
+		}
+		if sha256Digest(content) != layer.Digest {
+			return "", fmt.Errorf("digest of chart %s version %s does not match the manifest", chart, version)
+		}
+		chartFile := fmt.Sprintf("%s-%s.tgz", chart, ociVersion(tag))
+		return chartFile, afero.WriteFile(fs, filepath.Join(tmpDir, chartFile), content, 0644)
+	}
+	return "", fmt.Errorf("no chart found in manifest of chart %s version %s", chart, version)
+}
+
+// ociReference returns the reference of the chart in the OCI repository.
+func ociReference(repository, chart string) imageReference {
+	parts := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(repository, "oci://"), "/"), "/", 2)
+	ref := imageReference{Registry: parts[0], Repository: chart}
+	if len(parts) == 2 {
+		ref.Repository = parts[1] + "/" + chart
+	}
+	return ref
+}
+
+// ociTag returns the tag of the chart version, helm replaces + of semantic versions, it is not allowed in tags.
+func ociTag(version string) string {
+	return strings.Replace(version, "+", "_", -1)
+}
+
+// ociVersion reverts ociTag.
+func ociVersion(tag string) string {
+	return strings.Replace(tag, "_", "+", -1)
+}
+
+// resolveOCITag returns the tag of the chart version. Like helm, a version which is not a strict semantic version is
+// a constraint, the highest matching version of the tags of the repository is used then.
+func resolveOCITag(ctx context.Context, ref imageReference, version string, credentials registryCredentials) (string, error) {
+	if _, err := semver.StrictNewVersion(version); err == nil {
+		return ociTag(version), nil
+	}
+	content, err := registryContent(ctx, fmt.Sprintf("https://%s/v2/%s/tags/list", ref.Registry, ref.Repository), ref, credentials)
+	if err != nil {
+		return "", err
+	}
+	tags := struct {
+		Tags []string `json:"tags"`
+	}{}
+	err = json.Unmarshal(content, &tags)
+	if err != nil {
+		return "", fmt.Errorf("invalid tag list: %v", err)
+	}
+	versions := make([]string, 0, len(tags.Tags))
+	for _, tag := range tags.Tags {
+		versions = append(versions, ociVersion(tag))
+	}
+	selected, found := selectVersion(versions, version)
+	if !found {
+		return "", fmt.Errorf("no tag matches %s", version)
+	}
+	return ociTag(selected), nil
+}
+
+// selectVersion returns the version of versions matching version. Like helm fetch --version, version is either a
+// version which has to match exactly or a semantic version constraint like ^1.2 or ~5.6, the highest matching
+// version wins then.
+func selectVersion(versions []string, version string) (string, bool) {
+	for _, candidate := range versions {
+		if candidate == version {
+			return candidate, true
+		}
+	}
+	constraint, err := semver.NewConstraint(version)
+	if err != nil {
+		return "", false
+	}
+	var highest *semver.Version
+	selected := ""
+	for _, candidate := range versions {
+		parsed, err := semver.NewVersion(candidate)
+		if err != nil || !constraint.Check(parsed) {
+			continue
+		}
+		if highest == nil || parsed.GreaterThan(highest) {
+			highest, selected = parsed, candidate
+		}
+	}
+	return selected, highest != nil
+}
+
+func ociCredentials(config Repository) (registryCredentials, error) {
+	client, err := httpClient(config, nil)
+	if err != nil {
+		return registryCredentials{}, err
+	}
+	return registryCredentials{Username: config.Username, Password: config.Password, Client: client}, nil
+}
+
+// httpClient returns a client with the TLS settings of the repository, or defaultClient if there are none.
+func httpClient(config Repository, defaultClient *http.Client) (*http.Client, error) {
+	if config.CAFile == "" && config.CertFile == "" && config.KeyFile == "" && !config.InsecureSkipTLSVerify {
+		return defaultClient, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipTLSVerify}
+	if config.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		ca, err := afero.ReadFile(fs, config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		certificate, err := loadClientCertificate(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+func loadClientCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	certificate, err := afero.ReadFile(fs, certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, err := afero.ReadFile(fs, keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certificate, key)
+}
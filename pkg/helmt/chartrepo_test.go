@@ -0,0 +1,235 @@
+package helmt
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestChartRepository serves an index.yaml with a relative and an absolute chart URL, the absolute one points to
+// mirror. Requests with other credentials than user/pass are rejected, the credentials received by mirror are recorded.
+func newTestChartRepository(t *testing.T, tls bool, mirror string) *httptest.Server {
+	var server *httptest.Server
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		if username != "user" || password != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/stable/index.yaml":
+			_, _ = fmt.Fprintf(w, `apiVersion: v1
+entries:
+  jenkins:
+    - version: 2.0.0
+      urls:
+        - charts/jenkins-2.0.0.tgz
+    - version: 1.0.0
+      urls:
+        - %s/jenkins-1.0.0.tgz
+    - version: 2.1.0
+      urls:
+        - charts/jenkins-2.1.0.tgz?token=abc
+    - version: 0.3.0
+      urls:
+        - charts/%%2e%%2e
+    - version: 0.2.0
+      urls:
+        - /
+    - version: 0.1.0
+      urls:
+        - charts/..%%5Cjenkins-0.1.0.tgz
+`, mirror)
+		case "/stable/charts/jenkins-2.0.0.tgz":
+			_, _ = w.Write([]byte("chart"))
+		case "/stable/charts/jenkins-2.0.0.tgz.prov":
+			_, _ = w.Write([]byte("provenance"))
+		case "/stable/charts/jenkins-2.1.0.tgz":
+			_, _ = w.Write([]byte("chart 2.1.0"))
+		case "/stable/charts/jenkins-2.1.0.tgz.prov":
+			if r.URL.RawQuery != "token=abc" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte("provenance"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	if tls {
+		server = httptest.NewTLSServer(handler)
+	} else {
+		server = httptest.NewServer(handler)
+	}
+	return server
+}
+
+func Test_downloadChart(t *testing.T) {
+	var mirrorCredentials string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		mirrorCredentials = username + ":" + password
+		if strings.HasSuffix(r.URL.Path, ".prov") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("mirrored chart"))
+	}))
+	defer mirror.Close()
+	server := newTestChartRepository(t, false, mirror.URL)
+	defer server.Close()
+	credentials := Repository{Username: "user", Password: "pass"}
+
+	tests := []struct {
+		name           string
+		version        string
+		config         Repository
+		provenance     bool
+		wantFile       string
+		wantContent    string
+		wantProvenance bool
+		wantMirrorAuth string
+		wantErr        string
+	}{
+		{name: "relative URL", version: "2.0.0", config: credentials, wantFile: "jenkins-2.0.0.tgz", wantContent: "chart"},
+		{name: "provenance", version: "2.0.0", config: credentials, provenance: true, wantFile: "jenkins-2.0.0.tgz", wantContent: "chart", wantProvenance: true},
+		{name: "absolute URL of another host", version: "1.0.0", config: credentials, provenance: true, wantFile: "jenkins-1.0.0.tgz", wantContent: "mirrored chart", wantMirrorAuth: ":"},
+		{
+			name:           "pass credentials",
+			version:        "1.0.0",
+			config:         Repository{Username: "user", Password: "pass", PassCredentials: true},
+			wantFile:       "jenkins-1.0.0.tgz",
+			wantContent:    "mirrored chart",
+			wantMirrorAuth: "user:pass",
+		},
+		{name: "parent directory", version: "0.3.0", config: credentials, wantErr: fmt.Sprintf("invalid download URL %s/stable/charts/%%2e%%2e of chart jenkins version 0.3.0", server.URL)},
+		{name: "root directory", version: "0.2.0", config: credentials, wantErr: fmt.Sprintf("invalid download URL %s/ of chart jenkins version 0.2.0", server.URL)},
+		{name: "backslash", version: "0.1.0", config: credentials, wantErr: fmt.Sprintf("invalid download URL %s/stable/charts/..%%5Cjenkins-0.1.0.tgz of chart jenkins version 0.1.0", server.URL)},
+		{name: "provenance of URL with query", version: "2.1.0", config: credentials, provenance: true, wantFile: "jenkins-2.1.0.tgz", wantContent: "chart 2.1.0", wantProvenance: true},
+		{name: "constraint", version: "^1.0", config: credentials, wantFile: "jenkins-1.0.0.tgz", wantContent: "mirrored chart", wantMirrorAuth: ":"},
+		{name: "highest matching version", version: ">=1.0.0 <2.1.0", config: credentials, wantFile: "jenkins-2.0.0.tgz", wantContent: "chart"},
+		{name: "tilde constraint", version: "~2.1", config: credentials, wantFile: "jenkins-2.1.0.tgz", wantContent: "chart 2.1.0"},
+		{name: "unmatched constraint", version: "^5.6", config: credentials, wantErr: fmt.Sprintf("chart jenkins version ^5.6 not found in repository %s/stable", server.URL)},
+		{name: "unknown version", version: "3.0.0", config: credentials, wantErr: fmt.Sprintf("chart jenkins version 3.0.0 not found in repository %s/stable", server.URL)},
+		{name: "wrong credentials", version: "2.0.0", config: Repository{Username: "user", Password: "wrong"}, wantErr: fmt.Sprintf("failed to read index of repository %[1]s/stable: request to %[1]s/stable/index.yaml failed: 401 Unauthorized", server.URL)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs = afero.NewMemMapFs()
+			mirrorCredentials = ""
+
+			chartFile, err := downloadChart(context.Background(), "/temp/helmt-123", server.URL+"/stable", "jenkins", tt.version, tt.config, tt.provenance)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantFile, chartFile)
+			assert.Equal(t, tt.wantContent, ReadFileAsString(t, filepath.Join("/temp/helmt-123", chartFile)))
+			exists, err := afero.Exists(fs, filepath.Join("/temp/helmt-123", chartFile+".prov"))
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantProvenance, exists)
+			assert.Equal(t, tt.wantMirrorAuth, mirrorCredentials)
+		})
+	}
+}
+
+func Test_downloadChartWithCAFile(t *testing.T) {
+	server := newTestChartRepository(t, true, "")
+	defer server.Close()
+	caFile := "/certs/ca.pem"
+	fs = afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644))
+
+	_, err := downloadChart(context.Background(), "/temp/helmt-123", server.URL+"/stable", "jenkins", "2.0.0", Repository{Username: "user", Password: "pass"}, false)
+	assert.Error(t, err)
+
+	chartFile, err := downloadChart(context.Background(), "/temp/helmt-123", server.URL+"/stable", "jenkins", "2.0.0", Repository{Username: "user", Password: "pass", CAFile: caFile}, false)
+	require.NoError(t, err)
+	assert.Equal(t, "chart", ReadFileAsString(t, filepath.Join("/temp/helmt-123", chartFile)))
+
+	chartFile, err = downloadChart(context.Background(), "/temp/helmt-123", server.URL+"/stable", "jenkins", "2.0.0", Repository{Username: "user", Password: "pass", InsecureSkipTLSVerify: true}, false)
+	require.NoError(t, err)
+	assert.Equal(t, "jenkins-2.0.0.tgz", chartFile)
+}
+
+func Test_pullChart(t *testing.T) {
+	chartPackage := []byte("chart")
+	manifest, err := json.Marshal(ociManifest{Layers: []ociDescriptor{
+		{MediaType: "application/vnd.cncf.helm.config.v1+json", Digest: sha256Digest([]byte("{}"))},
+		{MediaType: helmChartLayerType, Digest: sha256Digest(chartPackage)},
+	}})
+	require.NoError(t, err)
+	content := map[string][]byte{
+		"/v2/charts/jenkins/manifests/2.0.0_build.1":              manifest,
+		"/v2/charts/jenkins/tags/list":                            []byte(`{"name":"charts/jenkins","tags":["1.0.0","2.0.0_build.1","3.0.0-rc.1"]}`),
+		"/v2/charts/jenkins/blobs/" + sha256Digest(chartPackage):  chartPackage,
+		"/v2/charts/tampered/manifests/2.0.0":                     manifest,
+		"/v2/charts/tampered/blobs/" + sha256Digest(chartPackage): []byte("tampered"),
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		body, ok := content[r.URL.Path]
+		switch {
+		case username != "user" || password != "pass":
+			w.WriteHeader(http.StatusUnauthorized)
+		case !ok:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			_, _ = w.Write(body)
+		}
+	}))
+	defer server.Close()
+	registryClient = server.Client()
+	repository := "oci://" + strings.TrimPrefix(server.URL, "https://") + "/charts"
+	credentials := Repository{Username: "user", Password: "pass"}
+	fs = afero.NewMemMapFs()
+
+	chartFile, err := pullChart(context.Background(), "/temp/helmt-123", repository, "jenkins", "2.0.0+build.1", credentials)
+	require.NoError(t, err)
+	assert.Equal(t, "jenkins-2.0.0+build.1.tgz", chartFile)
+	assert.Equal(t, "chart", ReadFileAsString(t, "/temp/helmt-123/jenkins-2.0.0+build.1.tgz"))
+
+	chartFile, err = pullChart(context.Background(), "/temp/helmt-123", repository, "jenkins", "^2.0", credentials)
+	require.NoError(t, err)
+	assert.Equal(t, "jenkins-2.0.0+build.1.tgz", chartFile)
+
+	_, err = pullChart(context.Background(), "/temp/helmt-123", repository, "jenkins", "~5.6", credentials)
+	assert.EqualError(t, err, "failed to resolve chart jenkins version ~5.6: no tag matches ~5.6")
+
+	_, err = pullChart(context.Background(), "/temp/helmt-123", repository, "tampered", "2.0.0", credentials)
+	assert.EqualError(t, err, "digest of chart tampered version 2.0.0 does not match the manifest")
+
+	_, err = pullChart(context.Background(), "/temp/helmt-123", repository, "jenkins", "3.0.0", credentials)
+	assert.EqualError(t, err, fmt.Sprintf("failed to read manifest of chart jenkins version 3.0.0: request to %s/v2/charts/jenkins/manifests/3.0.0 failed: 404 Not Found", server.URL))
+}
+
+func Test_resolveChartURL(t *testing.T) {
+	tests := []struct {
+		repository string
+		chartURL   string
+		expected   string
+	}{
+		{repository: "https://charts.example.com/stable", chartURL: "jenkins-2.0.0.tgz", expected: "https://charts.example.com/stable/jenkins-2.0.0.tgz"},
+		{repository: "https://charts.example.com/stable/", chartURL: "charts/jenkins-2.0.0.tgz", expected: "https://charts.example.com/stable/charts/jenkins-2.0.0.tgz"},
+		{repository: "https://charts.example.com/stable", chartURL: "/download/jenkins-2.0.0.tgz", expected: "https://charts.example.com/download/jenkins-2.0.0.tgz"},
+		{repository: "https://charts.example.com/stable", chartURL: "https://github.com/jenkinsci/helm-charts/releases/download/jenkins-2.0.0/jenkins-2.0.0.tgz", expected: "https://github.com/jenkinsci/helm-charts/releases/download/jenkins-2.0.0/jenkins-2.0.0.tgz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.chartURL, func(t *testing.T) {
+			actual, err := resolveChartURL(tt.repository, tt.chartURL)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, actual.String())
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package helmt
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// configPathKeys are the config keys holding files which are resolved against the directory of the config file
+// defining them, * matches every entry of a map. Keys are lower case as viper stores them.
+var configPathKeys = [][]string{
+	{strings.ToLower(repositoriesKey), "*", "cafile"},
+	{strings.ToLower(repositoriesKey), "*", "certfile"},
+	{strings.ToLower(repositoriesKey), "*", "keyfile"},
+	{strings.ToLower(capabilitiesKey), "*", "apiversionsfile"},
+	{strings.ToLower(verifyKey), "keyring"},
+	{strings.ToLower(verifyKey), "publickey"},
+	{strings.ToLower(policiesKey), "reportfile"},
+}
+
+// MergeConfigFile merges the config file into the config read so far. Relative files in it are resolved against its
+// directory when it is read, so that the config of the home directory and the project config can both use them.
+func MergeConfigFile(file string) error {
+	config := viper.New()
+	config.SetConfigFile(file)
+	err := config.ReadInConfig()
+	if err != nil {
+		return err
+	}
+
+	// AllSettings splits keys at dots, which would break the URLs of repositories, so take the sections as they are
+	settings := map[string]interface{}{}
+	for key := range config.AllSettings() {
+		settings[key] = config.Get(key)
+	}
+	for _, key := range configPathKeys {
+		resolveConfigPath(settings, key, filepath.Dir(file))
+	}
+	return viper.MergeConfigMap(settings)
+}
+
+func resolveConfigPath(settings map[string]interface{}, key []string, dir string) {
+	if len(key) == 1 {
+		if file, ok := settings[key[0]].(string); ok && file != "" && !filepath.IsAbs(file) {
+			settings[key[0]] = filepath.Join(dir, file)
+		}
+		return
+	}
+	for name, value := range settings {
+		if key[0] != "*" && name != key[0] {
+			continue
+		}
+		if section, ok := value.(map[string]interface{}); ok {
+			resolveConfigPath(section, key[1:], dir)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package helmt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeConfigFile(t *testing.T) {
+	defer viper.Reset()
+	home := filepath.Join(t.TempDir(), "home")
+	project := filepath.Join(t.TempDir(), "project")
+	require.NoError(t, os.MkdirAll(home, 0755))
+	require.NoError(t, os.MkdirAll(project, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(home, ".helmt.yaml"), []byte(`repositories:
+  https://charts.example.com/internal:
+    caFile: certs/ca.pem
+    keyFile: /etc/helmt/client-key.pem
+verify:
+  keyring: keys/pubring.gpg
+  publicKey: keys/cosign.pub
+policies:
+  reportFile: reports/policy-report.sarif
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(project, ".helmt.yaml"), []byte(`repositories:
+  https://charts.example.com/internal:
+    certFile: certs/client.pem
+capabilities:
+  prod:
+    apiVersionsFile: prod-api-versions.txt
+verify:
+  publicKey: cosign.pub
+`), 0644))
+
+	require.NoError(t, MergeConfigFile(filepath.Join(home, ".helmt.yaml")))
+	require.NoError(t, MergeConfigFile(filepath.Join(project, ".helmt.yaml")))
+
+	repository, err := repositoryConfig("https://charts.example.com/internal/stable", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, Repository{
+		CAFile:   filepath.Join(home, "certs/ca.pem"),
+		CertFile: filepath.Join(project, "certs/client.pem"),
+		KeyFile:  "/etc/helmt/client-key.pem",
+	}, repository)
+
+	verification, err := mergeVerification(Verification{})
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(home, "keys/pubring.gpg"), verification.Keyring)
+	assert.Equal(t, filepath.Join(project, "cosign.pub"), verification.PublicKey)
+
+	policies := Policies{}
+	require.NoError(t, viper.UnmarshalKey(policiesKey, &policies))
+	assert.Equal(t, filepath.Join(home, "reports/policy-report.sarif"), policies.ReportFile)
+
+	profiles := map[string]CapabilitiesProfile{}
+	require.NoError(t, viper.UnmarshalKey(capabilitiesKey, &profiles))
+	assert.Equal(t, filepath.Join(project, "prod-api-versions.txt"), profiles["prod"].ApiVersionsFile)
+
+	assert.Error(t, MergeConfigFile(filepath.Join(project, "missing.yaml")))
+}
@@ -0,0 +1,71 @@
+package helmt
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// separateCRDsCommand moves all CustomResourceDefinitions found in directory, no matter whether they are located
+// in crds/ or rendered by a template, into crdsDirectory. The relative file names are kept.
+func separateCRDsCommand(directory, crdsDirectory string) error {
+	return walkManifests(directory, func(path string, documents [][]byte) error {
+		var crds, others [][]byte
+		for _, document := range documents {
+			header, err := parseManifestHeader(document)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", path, err)
+			}
+			if header.Kind == "CustomResourceDefinition" {
+				crds = append(crds, document)
+			} else {
+				others = append(others, document)
+			}
+		}
+		if len(crds) == 0 {
+			return nil
+		}
+
+		rel, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(crdsDirectory, rel)
+		err = fs.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+		err = afero.WriteFile(fs, target, joinDocuments(crds), 0644)
+		if err != nil {
+			return err
+		}
+
+		if len(others) == 0 {
+			return removeFileAndEmptyParents(directory, path)
+		}
+		return afero.WriteFile(fs, path, joinDocuments(others), 0644)
+	})
+}
+
+// removeFileAndEmptyParents removes path and all of its parent directories below root which are empty afterwards.
+func removeFileAndEmptyParents(root, path string) error {
+	err := fs.Remove(path)
+	if err != nil {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != root && dir != "."; dir = filepath.Dir(dir) {
+		empty, err := afero.IsEmpty(fs, dir)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return nil
+		}
+		err = fs.Remove(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package helmt
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/otiai10/copy"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_separateCRDs(t *testing.T) {
+	fs = afero.NewOsFs()
+	dir, err := ioutil.TempDir("", "crds")
+	require.NoError(t, err)
+	defer func() { _ = fs.RemoveAll(dir) }()
+	rendered := filepath.Join(dir, "mixed-crds")
+	require.NoError(t, copy.Copy("testdata/mixed-crds", rendered))
+
+	err = separateCRDsCommand(rendered, rendered+"-crds")
+	require.NoError(t, err)
+
+	exists, err := afero.Exists(fs, filepath.Join(rendered, "crds"))
+	require.NoError(t, err)
+	assert.False(t, exists, "empty crds directory should be removed")
+	assert.Equal(t, `---
+# Source: mixed-crds/templates/bundle.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings`, ReadFileAsString(t, filepath.Join(rendered, "templates/bundle.yaml")))
+	assert.Equal(t, `---
+# Source: mixed-crds/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: operator`, ReadFileAsString(t, filepath.Join(rendered, "templates/deployment.yaml")))
+
+	assert.Equal(t, `---
+# Source: mixed-crds/crds/crd-backups.yaml
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: backups.example.com`, ReadFileAsString(t, filepath.Join(rendered+"-crds", "crds/crd-backups.yaml")))
+	assert.Equal(t, `---
+# Source: mixed-crds/templates/bundle.yaml
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: schedules.example.com`, ReadFileAsString(t, filepath.Join(rendered+"-crds", "templates/bundle.yaml")))
+	exists, err = afero.Exists(fs, filepath.Join(rendered+"-crds", "templates/deployment.yaml"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func Test_separateCRDsWithoutCRDs(t *testing.T) {
+	fs = afero.NewOsFs()
+	dir, err := ioutil.TempDir("", "crds")
+	require.NoError(t, err)
+	defer func() { _ = fs.RemoveAll(dir) }()
+	rendered := filepath.Join(dir, "jenkins")
+	require.NoError(t, copy.Copy("testdata/jenkins", rendered))
+
+	err = separateCRDsCommand(rendered, rendered+"-crds")
+	require.NoError(t, err)
+
+	exists, err := afero.Exists(fs, rendered+"-crds")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
@@ -0,0 +1,55 @@
+package helmt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	credentialHelperKey    = "credentialHelper"
+	credentialHelperPrefix = "docker-credential-"
+	// credentialsNotFound is returned by docker credential helpers for unknown servers
+	credentialsNotFound = "credentials not found in native keychain"
+)
+
+type helperCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// credentialServer returns the server a credential helper is asked for, the host for OCI registries and the URL
+// otherwise.
+func credentialServer(url string) string {
+	if strings.HasPrefix(url, "oci://") {
+		return strings.SplitN(strings.TrimPrefix(url, "oci://"), "/", 2)[0]
+	}
+	return url
+}
+
+// credentialsFromHelper runs docker-credential-<helper> get following the docker credential helper protocol.
+// Empty credentials are returned if the helper does not know the server.
+func credentialsFromHelper(helper, server string) (string, string, error) {
+	output := &bytes.Buffer{}
+	err := execute(credentialHelperPrefix+helper, execOpts{Stdin: strings.NewReader(server), Output: output}, "get")
+	if err != nil {
+		if strings.Contains(output.String(), credentialsNotFound) {
+			return "", "", nil
+		}
+		message := strings.TrimFunc(output.String(), unicode.IsSpace)
+		if message != "" {
+			return "", "", fmt.Errorf("credential helper %s failed for %s: %v: %s", helper, server, err, message)
+		}
+		return "", "", fmt.Errorf("credential helper %s failed for %s: %v", helper, server, err)
+	}
+	credentials := helperCredentials{}
+	err = json.Unmarshal(output.Bytes(), &credentials)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid response of credential helper %s: %v", helper, err)
+	}
+	redactions.add(credentials.Secret)
+	return credentials.Username, credentials.Secret, nil
+}
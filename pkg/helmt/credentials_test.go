@@ -0,0 +1,111 @@
+package helmt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func useTestCredentialHelper(t *testing.T) func() {
+	bin, err := filepath.Abs("testdata/bin")
+	require.NoError(t, err)
+	path := os.Getenv("PATH")
+	require.NoError(t, os.Setenv("PATH", bin+string(os.PathListSeparator)+path))
+	previousExecute := execute
+	execute = execCommand
+	return func() {
+		execute = previousExecute
+		_ = os.Setenv("PATH", path)
+	}
+}
+
+func Test_credentialsFromHelper(t *testing.T) {
+	defer useTestCredentialHelper(t)()
+
+	tests := []struct {
+		server       string
+		wantUsername string
+		wantSecret   string
+		wantErr      string
+	}{
+		{server: "vault.example.com", wantUsername: "vault-user", wantSecret: "vault-secret"},
+		{server: "unknown.example.com"},
+		{server: "sealed.example.com", wantErr: "credential helper helmt-test failed for sealed.example.com: exit status 2: vault is sealed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			username, secret, err := credentialsFromHelper("helmt-test", tt.server)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantUsername, username)
+			assert.Equal(t, tt.wantSecret, secret)
+		})
+	}
+
+	_, _, err := credentialsFromHelper("missing", "vault.example.com")
+	assert.Error(t, err)
+}
+
+func Test_repositoryConfigWithCredentialHelper(t *testing.T) {
+	defer useTestCredentialHelper(t)()
+	require.NoError(t, MergeConfigFile("testdata/helmt-config.yaml"))
+	defer viper.Reset()
+
+	tests := []struct {
+		name     string
+		url      string
+		global   string
+		password string
+		expected Repository
+	}{
+		{
+			name:     "helper of repository",
+			url:      "oci://vault.example.com/charts",
+			expected: Repository{Username: "vault-user", Password: "vault-secret"},
+		},
+		{
+			name:     "global helper",
+			url:      "https://charts.example.org/vault",
+			global:   "helmt-test",
+			expected: Repository{Username: "robot", Password: "vault-token"},
+		},
+		{
+			name:     "global helper without credentials",
+			url:      "https://charts.example.org/public",
+			global:   "helmt-test",
+			expected: Repository{},
+		},
+		{
+			name:     "configured password takes precedence",
+			url:      "https://hub.example.com/chartrepo/vault",
+			global:   "helmt-test",
+			expected: Repository{Username: "reader", Password: "public-read"},
+		},
+		{
+			name:     "password flag takes precedence",
+			url:      "oci://vault.example.com/charts",
+			password: "flag",
+			expected: Repository{Password: "flag"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set(credentialHelperKey, tt.global)
+			actual, err := repositoryConfig(tt.url, "", tt.password)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func Test_credentialServer(t *testing.T) {
+	assert.Equal(t, "registry.example.com", credentialServer("oci://registry.example.com/charts/app"))
+	assert.Equal(t, "https://hub.example.com/chartrepo", credentialServer("https://hub.example.com/chartrepo"))
+}
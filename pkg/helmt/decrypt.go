@@ -0,0 +1,407 @@
+package helmt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// AgeKeyFileFlag names the flag and config key of the age identity file used to decrypt values
+	AgeKeyFileFlag = "age-key-file"
+	// decryptedValuesDir is located in the temporary directory, chart names can not start with a dot
+	decryptedValuesDir = ".decrypted-values"
+	defaultAgeKeyFile  = "~/.config/sops/age/keys.txt"
+)
+
+var sopsValuePattern = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]+),tag:([^,]+),type:([a-z]+)\]$`)
+
+// isMarkedEncrypted reports whether the file name of a values file declares it as encrypted.
+func isMarkedEncrypted(valuesFile string) bool {
+	base := filepath.Base(valuesFile)
+	return filepath.Ext(base) == ".age" || strings.Contains(base, ".enc.") || strings.Contains(base, ".sops.")
+}
+
+// decryptValuesCommand decrypts all age and SOPS encrypted values files into tmpDir and returns the list of values
+// files to pass to helm. Files are encrypted if their name ends with .age or contains .enc. or .sops., or if they
+// start with an age header or contain SOPS metadata. The plaintext files are removed together with tmpDir.
+func decryptValuesCommand(tmpDir string, values []string) ([]string, error) {
+	var identities []age.Identity
+	result := make([]string, 0, len(values))
+	for i, valuesFile := range values {
+		if isURL(valuesFile) {
+			// remote values files are read by helm itself
+			result = append(result, valuesFile)
+			continue
+		}
+		content, err := afero.ReadFile(fs, valuesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read values %s: %v", valuesFile, err)
+		}
+		sops := hasSopsMetadata(content)
+		if !isAgeEncrypted(content) && !sops {
+			if isMarkedEncrypted(valuesFile) {
+				return nil, fmt.Errorf("values %s are marked as encrypted but neither age nor SOPS encrypted", valuesFile)
+			}
+			result = append(result, valuesFile)
+			continue
+		}
+
+		if identities == nil {
+			identities, err = readAgeIdentities()
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt values %s: %v", valuesFile, err)
+			}
+		}
+		var plaintext []byte
+		if sops {
+			plaintext, err = sopsDecrypt(content, identities)
+		} else {
+			plaintext, err = ageDecrypt(content, identities)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt values %s: %v", valuesFile, err)
+		}
+		if !sops {
+			redactDecryptedValues(plaintext)
+		}
+
+		name := fmt.Sprintf("%d-%s", i, strings.TrimSuffix(filepath.Base(valuesFile), ".age"))
+		decrypted := filepath.Join(tmpDir, decryptedValuesDir, name)
+		err = writeFile(decrypted, plaintext, 0600)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, decrypted)
+	}
+	return result, nil
+}
+
+// redactDecryptedValues registers all strings of an age decrypted values file for redaction. Numbers and booleans are
+// no secrets, masking every true or 8080 would make the output unreadable.
+func redactDecryptedValues(plaintext []byte) {
+	var values interface{}
+	if yaml.Unmarshal(plaintext, &values) != nil {
+		redactions.add(strings.TrimSpace(string(plaintext)))
+		return
+	}
+	redactStrings(values)
+}
+
+func redactStrings(value interface{}) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for _, item := range v {
+			redactStrings(item)
+		}
+	case []interface{}:
+		for _, item := range v {
+			redactStrings(item)
+		}
+	case string:
+		redactions.add(v)
+	}
+}
+
+// isURL reports whether the values file is given as URL with a scheme, like https://example.com/values.yaml.
+// A Windows path like C:\values.yaml is no URL.
+func isURL(valuesFile string) bool {
+	parsed, err := url.Parse(valuesFile)
+	return err == nil && len(parsed.Scheme) > 1
+}
+
+// readAgeIdentities reads the identities from SOPS_AGE_KEY, the file given by --age-key-file, SOPS_AGE_KEY_FILE
+// or the default location of SOPS.
+func readAgeIdentities() ([]age.Identity, error) {
+	if key := os.Getenv("SOPS_AGE_KEY"); key != "" {
+		return parseAgeIdentities([]byte(key))
+	}
+	keyFile := firstNonEmpty(viper.GetString(AgeKeyFileFlag), os.Getenv("SOPS_AGE_KEY_FILE"), defaultAgeKeyFile)
+	keyFile, err := homedir.Expand(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	content, err := afero.ReadFile(fs, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age key file: %v", err)
+	}
+	identities, err := parseAgeIdentities(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keyFile, err)
+	}
+	return identities, nil
+}
+
+type sopsMetadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+	LastModified      string `yaml:"lastmodified"`
+	MAC               string `yaml:"mac"`
+	UnencryptedSuffix string `yaml:"unencrypted_suffix"`
+	EncryptedSuffix   string `yaml:"encrypted_suffix"`
+	UnencryptedRegex  string `yaml:"unencrypted_regex"`
+	EncryptedRegex    string `yaml:"encrypted_regex"`
+	MACOnlyEncrypted  bool   `yaml:"mac_only_encrypted"`
+}
+
+func hasSopsMetadata(content []byte) bool {
+	document := struct {
+		Sops *struct {
+			Version string `yaml:"version"`
+		} `yaml:"sops"`
+	}{}
+	if yaml.Unmarshal(content, &document) != nil {
+		return false
+	}
+	return document.Sops != nil && document.Sops.Version != ""
+}
+
+// sopsDecryption holds the state of decrypting a SOPS file. Like SOPS, all values are hashed in the order of the
+// file to verify the MAC, so that values can neither be removed, reordered nor added.
+type sopsDecryption struct {
+	metadata         sopsMetadata
+	dataKey          []byte
+	hash             hash.Hash
+	unencryptedRegex *regexp.Regexp
+	encryptedRegex   *regexp.Regexp
+}
+
+// sopsDecrypt decrypts a SOPS encrypted yaml file whose data key is encrypted for age and verifies its MAC.
+func sopsDecrypt(content []byte, identities []age.Identity) ([]byte, error) {
+	document := yaml.MapSlice{}
+	err := yaml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, err
+	}
+	metadata := struct {
+		Sops sopsMetadata `yaml:"sops"`
+	}{}
+	err = yaml.Unmarshal(content, &metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	decryption := &sopsDecryption{metadata: metadata.Sops, hash: sha512.New()}
+	for _, entry := range metadata.Sops.Age {
+		if key, err := ageDecrypt([]byte(entry.Enc), identities); err == nil {
+			decryption.dataKey = key
+			break
+		}
+	}
+	if decryption.dataKey == nil {
+		return nil, errors.New("no matching age identity found")
+	}
+	if metadata.Sops.UnencryptedRegex != "" {
+		decryption.unencryptedRegex, err = regexp.Compile(metadata.Sops.UnencryptedRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unencrypted_regex: %v", err)
+		}
+	}
+	if metadata.Sops.EncryptedRegex != "" {
+		decryption.encryptedRegex, err = regexp.Compile(metadata.Sops.EncryptedRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encrypted_regex: %v", err)
+		}
+	}
+
+	values := yaml.MapSlice{}
+	for _, item := range document {
+		if item.Key == "sops" {
+			continue
+		}
+		value, err := decryption.decrypt(item.Value, []string{fmt.Sprint(item.Key)})
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, yaml.MapItem{Key: item.Key, Value: value})
+	}
+	err = decryption.verifyMAC()
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(values)
+}
+
+// decrypt decrypts value and all values nested in it. The path of keys is the additional authenticated data,
+// list items share the path of their parent.
+func (d *sopsDecryption) decrypt(value interface{}, path []string) (interface{}, error) {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		result := yaml.MapSlice{}
+		for _, item := range v {
+			decrypted, err := d.decrypt(item.Value, append(append([]string{}, path...), fmt.Sprint(item.Key)))
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, yaml.MapItem{Key: item.Key, Value: decrypted})
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			decrypted, err := d.decrypt(item, path)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, decrypted)
+		}
+		return result, nil
+	}
+
+	encrypted := d.isEncrypted(path)
+	if !encrypted {
+		if !d.metadata.MACOnlyEncrypted {
+			d.hash.Write(sopsBytes(value))
+		}
+		return value, nil
+	}
+	text, _ := value.(string)
+	if text == "" && value != nil {
+		// SOPS keeps empty strings as they are
+		d.hash.Write(nil)
+		return "", nil
+	}
+	match := sopsValuePattern.FindStringSubmatch(text)
+	if match == nil {
+		return nil, fmt.Errorf("value %s is not encrypted", strings.Join(path, "."))
+	}
+	plaintext, err := sopsDecryptString(match, d.dataKey, strings.Join(path, ":")+":")
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %v", strings.Join(path, "."), err)
+	}
+	typed, err := sopsTypedValue(plaintext, match[4])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %v", strings.Join(path, "."), err)
+	}
+	redactStrings(typed)
+	d.hash.Write(sopsBytes(typed))
+	return typed, nil
+}
+
+// isEncrypted decides like SOPS whether the value at path has to be encrypted.
+func (d *sopsDecryption) isEncrypted(path []string) bool {
+	encrypted := true
+	if d.metadata.UnencryptedSuffix != "" && anyKey(path, func(key string) bool { return strings.HasSuffix(key, d.metadata.UnencryptedSuffix) }) {
+		encrypted = false
+	}
+	if d.metadata.EncryptedSuffix != "" {
+		encrypted = anyKey(path, func(key string) bool { return strings.HasSuffix(key, d.metadata.EncryptedSuffix) })
+	}
+	if d.unencryptedRegex != nil && anyKey(path, d.unencryptedRegex.MatchString) {
+		encrypted = false
+	}
+	if d.encryptedRegex != nil {
+		encrypted = anyKey(path, d.encryptedRegex.MatchString)
+	}
+	return encrypted
+}
+
+func anyKey(path []string, matches func(key string) bool) bool {
+	for _, key := range path {
+		if matches(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyMAC compares the hash of all values with the MAC of the file, which is encrypted using the last modification
+// time as additional data.
+func (d *sopsDecryption) verifyMAC() error {
+	match := sopsValuePattern.FindStringSubmatch(d.metadata.MAC)
+	if match == nil {
+		return errors.New("MAC of the file is missing")
+	}
+	lastModified, err := time.Parse(time.RFC3339, d.metadata.LastModified)
+	if err != nil {
+		return fmt.Errorf("invalid lastmodified: %v", err)
+	}
+	mac, err := sopsDecryptString(match, d.dataKey, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt MAC: %v", err)
+	}
+	if mac != fmt.Sprintf("%X", d.hash.Sum(nil)) {
+		return errors.New("MAC mismatch, the file has been modified")
+	}
+	return nil
+}
+
+// sopsBytes converts a value into the bytes SOPS hashes for the MAC.
+func sopsBytes(value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		return []byte(v)
+	case int:
+		return []byte(strconv.Itoa(v))
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		if v {
+			return []byte("True")
+		}
+		return []byte("False")
+	case nil:
+		return nil
+	default:
+		return []byte(fmt.Sprint(v))
+	}
+}
+
+func sopsDecryptString(match []string, dataKey []byte, additionalData string) (string, error) {
+	var parts [3][]byte
+	for i := range parts {
+		decoded, err := base64.StdEncoding.DecodeString(match[i+1])
+		if err != nil {
+			return "", err
+		}
+		parts[i] = decoded
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return "", errors.New("authentication failed")
+	}
+	return string(plaintext), nil
+}
+
+func sopsTypedValue(plaintext, valueType string) (interface{}, error) {
+	switch valueType {
+	case "str", "bytes", "comment":
+		return plaintext, nil
+	case "int":
+		return strconv.Atoi(plaintext)
+	case "float":
+		return strconv.ParseFloat(plaintext, 64)
+	case "bool":
+		return strconv.ParseBool(plaintext)
+	default:
+		return nil, fmt.Errorf("unknown type %s", valueType)
+	}
+}
@@ -0,0 +1,215 @@
+package helmt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_decryptValues(t *testing.T) {
+	tests := []struct {
+		name         string
+		keyFile      string
+		values       []string
+		wantValues   []string
+		wantContents map[string]string
+		wantErr      string
+	}{
+		{
+			name:       "plain values",
+			values:     []string{"testdata/prometheus-operator-values.yaml"},
+			wantValues: []string{"testdata/prometheus-operator-values.yaml"},
+		},
+		{
+			name:       "remote values",
+			values:     []string{"https://example.com/values.yaml", "s3://bucket/values.sops.yaml", "testdata/prometheus-operator-values.yaml"},
+			wantValues: []string{"https://example.com/values.yaml", "s3://bucket/values.sops.yaml", "testdata/prometheus-operator-values.yaml"},
+		},
+		{
+			name:       "age and sops",
+			keyFile:    "testdata/age/key.txt",
+			values:     []string{"testdata/prometheus-operator-values.yaml", "testdata/age/values.yaml.age", "testdata/age/values.sops.yaml", "testdata/age/values.bin.age"},
+			wantValues: []string{"testdata/prometheus-operator-values.yaml", ".decrypted-values/1-values.yaml", ".decrypted-values/2-values.sops.yaml", ".decrypted-values/3-values.bin"},
+			wantContents: map[string]string{
+				".decrypted-values/1-values.yaml": "replicaCount: 2\nadminPassword: hunter22\n",
+				".decrypted-values/2-values.sops.yaml": `replicaCount: 2
+admin:
+  user: admin
+  password: hunter22
+  port: 8080
+  enabled: true
+  ratio: 0.5
+ingress:
+  hosts:
+  - name: jenkins.example.com
+    tls: true
+  tokens:
+  - abc123
+  - def456
+plain_unencrypted: visible
+`,
+			},
+		},
+		{
+			name:    "marked as encrypted",
+			values:  []string{"testdata/age/plain.enc.yaml"},
+			wantErr: "values testdata/age/plain.enc.yaml are marked as encrypted but neither age nor SOPS encrypted",
+		},
+		{
+			name:    "missing key file",
+			keyFile: "testdata/age/missing.txt",
+			values:  []string{"testdata/age/values.sops.yaml"},
+			wantErr: "failed to decrypt values testdata/age/values.sops.yaml: failed to read age key file: open testdata/age/missing.txt: no such file or directory",
+		},
+		{
+			name:    "wrong key",
+			keyFile: "testdata/age/other-key.txt",
+			values:  []string{"testdata/age/values.sops.yaml"},
+			wantErr: "failed to decrypt values testdata/age/values.sops.yaml: no matching age identity found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs = afero.NewOsFs()
+			previousRedactions := redactions
+			redactions = &redactor{}
+			defer func() { redactions = previousRedactions }()
+			viper.Set(AgeKeyFileFlag, tt.keyFile)
+			defer viper.Reset()
+			previous, set := os.LookupEnv("SOPS_AGE_KEY")
+			require.NoError(t, os.Unsetenv("SOPS_AGE_KEY"))
+			if set {
+				defer os.Setenv("SOPS_AGE_KEY", previous)
+			}
+			tmpDir, err := ioutil.TempDir("", "helmt")
+			require.NoError(t, err)
+			defer os.RemoveAll(tmpDir)
+
+			values, err := decryptValuesCommand(tmpDir, tt.values)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			var wantValues []string
+			for _, value := range tt.wantValues {
+				if filepath.Dir(value) == decryptedValuesDir {
+					value = filepath.Join(tmpDir, value)
+				}
+				wantValues = append(wantValues, value)
+			}
+			assert.Equal(t, wantValues, values)
+			if tt.wantContents != nil {
+				assert.Equal(t, "password: *****, user: *****, port: 8080", redactions.redact("password: hunter22, user: admin, port: 8080"))
+			}
+			for file, expected := range tt.wantContents {
+				content, err := ioutil.ReadFile(filepath.Join(tmpDir, file))
+				require.NoError(t, err)
+				assert.Equal(t, expected, string(content))
+				info, err := os.Stat(filepath.Join(tmpDir, file))
+				require.NoError(t, err)
+				assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func Test_sopsDecryptTampered(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/age/values.sops.yaml")
+	require.NoError(t, err)
+	identities := readTestAgeIdentities(t)
+	tokens := regexp.MustCompile(`        - (ENC\[[^\]]+\])\n`).FindAllSubmatch(content, -1)
+	require.Len(t, tokens, 2)
+	password := regexp.MustCompile(`password: (ENC\[[^\]]+\])`).FindSubmatch(content)[1]
+
+	tests := []struct {
+		name    string
+		tamper  func(content []byte) []byte
+		wantErr string
+	}{
+		{
+			name: "value copied to another key",
+			tamper: func(content []byte) []byte {
+				return regexp.MustCompile(`user: ENC\[[^\]]+\]`).ReplaceAll(content, append([]byte("user: "), password...))
+			},
+			wantErr: "failed to decrypt admin.user: authentication failed",
+		},
+		{
+			name: "list items swapped",
+			tamper: func(content []byte) []byte {
+				content = bytes.Replace(content, tokens[0][1], []byte("first"), 1)
+				content = bytes.Replace(content, tokens[1][1], tokens[0][1], 1)
+				return bytes.Replace(content, []byte("first"), tokens[1][1], 1)
+			},
+			wantErr: "MAC mismatch, the file has been modified",
+		},
+		{
+			name: "value removed",
+			tamper: func(content []byte) []byte {
+				return bytes.Replace(content, append(append([]byte("        - "), tokens[1][1]...), '\n'), nil, 1)
+			},
+			wantErr: "MAC mismatch, the file has been modified",
+		},
+		{
+			name: "unencrypted value changed",
+			tamper: func(content []byte) []byte {
+				return bytes.Replace(content, []byte("plain_unencrypted: visible"), []byte("plain_unencrypted: changed"), 1)
+			},
+			wantErr: "MAC mismatch, the file has been modified",
+		},
+		{
+			name: "unencrypted value added",
+			tamper: func(content []byte) []byte {
+				return bytes.Replace(content, []byte("sops:\n"), []byte("extra_unencrypted: added\nsops:\n"), 1)
+			},
+			wantErr: "MAC mismatch, the file has been modified",
+		},
+		{
+			name: "plaintext value",
+			tamper: func(content []byte) []byte {
+				return bytes.Replace(content, []byte("sops:\n"), []byte("extra: added\nsops:\n"), 1)
+			},
+			wantErr: "value extra is not encrypted",
+		},
+		{
+			name: "last modification changed",
+			tamper: func(content []byte) []byte {
+				return bytes.Replace(content, []byte("2026-10-19T14:37:20Z"), []byte("2026-10-19T14:37:21Z"), 1)
+			},
+			wantErr: "failed to decrypt MAC: authentication failed",
+		},
+		{
+			name: "MAC removed",
+			tamper: func(content []byte) []byte {
+				return regexp.MustCompile(`    mac: ENC\[[^\]]+\]\n`).ReplaceAll(content, nil)
+			},
+			wantErr: "MAC of the file is missing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := tt.tamper(append([]byte{}, content...))
+			require.NotEqual(t, content, tampered)
+			_, err := sopsDecrypt(tampered, identities)
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func Test_redactDecryptedValues(t *testing.T) {
+	previous := redactions
+	redactions = &redactor{}
+	defer func() { redactions = previous }()
+
+	redactDecryptedValues([]byte("database:\n  user: service\n  port: 5432\nhosts:\n  - db.internal\n"))
+	redactDecryptedValues([]byte("not: [valid yaml\n"))
+	assert.Equal(t, "*****@*****:5432 *****", redactions.redact("service@db.internal:5432 not: [valid yaml"))
+}
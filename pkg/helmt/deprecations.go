@@ -0,0 +1,141 @@
+package helmt
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+type kubeVersion struct {
+	Major int
+	Minor int
+}
+
+type deprecatedAPI struct {
+	ApiVersion   string
+	Kinds        []string
+	DeprecatedIn kubeVersion
+	RemovedIn    kubeVersion
+	Replacement  string
+}
+
+// deprecatedAPIs lists the APIs removed from kubernetes, see https://kubernetes.io/docs/reference/using-api/deprecation-guide/
+var deprecatedAPIs = []deprecatedAPI{
+	{"extensions/v1beta1", []string{"Deployment", "DaemonSet", "ReplicaSet"}, kubeVersion{1, 9}, kubeVersion{1, 16}, "apps/v1"},
+	{"apps/v1beta1", []string{"Deployment", "StatefulSet", "ReplicaSet"}, kubeVersion{1, 9}, kubeVersion{1, 16}, "apps/v1"},
+	{"apps/v1beta2", []string{"Deployment", "StatefulSet", "DaemonSet", "ReplicaSet"}, kubeVersion{1, 9}, kubeVersion{1, 16}, "apps/v1"},
+	{"extensions/v1beta1", []string{"NetworkPolicy"}, kubeVersion{1, 9}, kubeVersion{1, 16}, "networking.k8s.io/v1"},
+	{"extensions/v1beta1", []string{"PodSecurityPolicy"}, kubeVersion{1, 11}, kubeVersion{1, 16}, "policy/v1beta1"},
+	{"extensions/v1beta1", []string{"Ingress"}, kubeVersion{1, 14}, kubeVersion{1, 22}, "networking.k8s.io/v1"},
+	{"networking.k8s.io/v1beta1", []string{"Ingress", "IngressClass"}, kubeVersion{1, 19}, kubeVersion{1, 22}, "networking.k8s.io/v1"},
+	{"admissionregistration.k8s.io/v1beta1", []string{"MutatingWebhookConfiguration", "ValidatingWebhookConfiguration"}, kubeVersion{1, 16}, kubeVersion{1, 22}, "admissionregistration.k8s.io/v1"},
+	{"apiextensions.k8s.io/v1beta1", []string{"CustomResourceDefinition"}, kubeVersion{1, 16}, kubeVersion{1, 22}, "apiextensions.k8s.io/v1"},
+	{"apiregistration.k8s.io/v1beta1", []string{"APIService"}, kubeVersion{1, 19}, kubeVersion{1, 22}, "apiregistration.k8s.io/v1"},
+	{"authentication.k8s.io/v1beta1", []string{"TokenReview"}, kubeVersion{1, 19}, kubeVersion{1, 22}, "authentication.k8s.io/v1"},
+	{"authorization.k8s.io/v1beta1", []string{"LocalSubjectAccessReview", "SelfSubjectAccessReview", "SubjectAccessReview"}, kubeVersion{1, 19}, kubeVersion{1, 22}, "authorization.k8s.io/v1"},
+	{"certificates.k8s.io/v1beta1", []string{"CertificateSigningRequest"}, kubeVersion{1, 19}, kubeVersion{1, 22}, "certificates.k8s.io/v1"},
+	{"coordination.k8s.io/v1beta1", []string{"Lease"}, kubeVersion{1, 19}, kubeVersion{1, 22}, "coordination.k8s.io/v1"},
+	{"rbac.authorization.k8s.io/v1beta1", []string{"ClusterRole", "ClusterRoleBinding", "Role", "RoleBinding"}, kubeVersion{1, 17}, kubeVersion{1, 22}, "rbac.authorization.k8s.io/v1"},
+	{"scheduling.k8s.io/v1beta1", []string{"PriorityClass"}, kubeVersion{1, 14}, kubeVersion{1, 22}, "scheduling.k8s.io/v1"},
+	{"storage.k8s.io/v1beta1", []string{"CSIDriver", "CSINode", "StorageClass", "VolumeAttachment"}, kubeVersion{1, 19}, kubeVersion{1, 22}, "storage.k8s.io/v1"},
+	{"batch/v1beta1", []string{"CronJob"}, kubeVersion{1, 21}, kubeVersion{1, 25}, "batch/v1"},
+	{"discovery.k8s.io/v1beta1", []string{"EndpointSlice"}, kubeVersion{1, 21}, kubeVersion{1, 25}, "discovery.k8s.io/v1"},
+	{"events.k8s.io/v1beta1", []string{"Event"}, kubeVersion{1, 19}, kubeVersion{1, 25}, "events.k8s.io/v1"},
+	{"autoscaling/v2beta1", []string{"HorizontalPodAutoscaler"}, kubeVersion{1, 22}, kubeVersion{1, 25}, "autoscaling/v2"},
+	{"policy/v1beta1", []string{"PodDisruptionBudget"}, kubeVersion{1, 21}, kubeVersion{1, 25}, "policy/v1"},
+	{"policy/v1beta1", []string{"PodSecurityPolicy"}, kubeVersion{1, 21}, kubeVersion{1, 25}, ""},
+	{"node.k8s.io/v1beta1", []string{"RuntimeClass"}, kubeVersion{1, 20}, kubeVersion{1, 25}, "node.k8s.io/v1"},
+	{"autoscaling/v2beta2", []string{"HorizontalPodAutoscaler"}, kubeVersion{1, 23}, kubeVersion{1, 26}, "autoscaling/v2"},
+	{"flowcontrol.apiserver.k8s.io/v1beta1", []string{"FlowSchema", "PriorityLevelConfiguration"}, kubeVersion{1, 23}, kubeVersion{1, 26}, "flowcontrol.apiserver.k8s.io/v1"},
+	{"storage.k8s.io/v1beta1", []string{"CSIStorageCapacity"}, kubeVersion{1, 24}, kubeVersion{1, 27}, "storage.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io/v1beta2", []string{"FlowSchema", "PriorityLevelConfiguration"}, kubeVersion{1, 26}, kubeVersion{1, 29}, "flowcontrol.apiserver.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io/v1beta3", []string{"FlowSchema", "PriorityLevelConfiguration"}, kubeVersion{1, 29}, kubeVersion{1, 32}, "flowcontrol.apiserver.k8s.io/v1"},
+}
+
+// parseKubeVersion parses versions like v1.25.3 or 1.25
+func parseKubeVersion(version string) (kubeVersion, error) {
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) < 2 {
+		return kubeVersion{}, fmt.Errorf("invalid kubernetes version %s", version)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return kubeVersion{}, fmt.Errorf("invalid kubernetes version %s", version)
+	}
+	// ignore suffixes of pre-releases or providers, like 1.21+ or 1.21-eks
+	minor, err := strconv.Atoi(strings.TrimRight(parts[1], "+-abcdefghijklmnopqrstuvwxyz"))
+	if err != nil {
+		return kubeVersion{}, fmt.Errorf("invalid kubernetes version %s", version)
+	}
+	return kubeVersion{Major: major, Minor: minor}, nil
+}
+
+func (v kubeVersion) atLeast(other kubeVersion) bool {
+	return v.Major > other.Major || (v.Major == other.Major && v.Minor >= other.Minor)
+}
+
+func (v kubeVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+func findDeprecatedAPI(apiVersion, kind string) *deprecatedAPI {
+	for i, api := range deprecatedAPIs {
+		if api.ApiVersion != apiVersion {
+			continue
+		}
+		for _, k := range api.Kinds {
+			if k == kind {
+				return &deprecatedAPIs[i]
+			}
+		}
+	}
+	return nil
+}
+
+// checkDeprecationsCommand reports all resources using APIs deprecated in the target kubernetes version.
+// Resources using APIs which have been removed in the target version are treated as error.
+func checkDeprecationsCommand(directory, version string) error {
+	target, err := parseKubeVersion(version)
+	if err != nil {
+		return err
+	}
+
+	var removed []string
+	err = walkManifests(directory, func(path string, documents [][]byte) error {
+		rel, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		for _, document := range documents {
+			header, err := parseManifestHeader(document)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", path, err)
+			}
+			api := findDeprecatedAPI(header.ApiVersion, header.Kind)
+			if api == nil || !target.atLeast(api.DeprecatedIn) {
+				continue
+			}
+			message := fmt.Sprintf("%s %s %s in %s", header.ApiVersion, header.Kind, header.Metadata.Name, filepath.ToSlash(rel))
+			hint := ""
+			if api.Replacement != "" {
+				hint = fmt.Sprintf(", use %s instead", api.Replacement)
+			}
+			if target.atLeast(api.RemovedIn) {
+				removed = append(removed, fmt.Sprintf("%s: removed in %s%s", message, api.RemovedIn, hint))
+				continue
+			}
+			color.Yellow("Warning: %s: deprecated in %s and removed in %s%s", message, api.DeprecatedIn, api.RemovedIn, hint)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(removed) > 0 {
+		return fmt.Errorf("APIs removed in kubernetes %s are used:\n  %s", target, strings.Join(removed, "\n  "))
+	}
+	return nil
+}
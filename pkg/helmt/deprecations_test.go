@@ -0,0 +1,69 @@
+package helmt
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseKubeVersion(t *testing.T) {
+	tests := []struct {
+		version  string
+		expected kubeVersion
+		wantErr  bool
+	}{
+		{version: "1.25", expected: kubeVersion{1, 25}},
+		{version: "v1.21.3", expected: kubeVersion{1, 21}},
+		{version: "1.21+", expected: kubeVersion{1, 21}},
+		{version: "v1.20.7-eks-8be107", expected: kubeVersion{1, 20}},
+		{version: "1", wantErr: true},
+		{version: "latest", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			actual, err := parseKubeVersion(tt.version)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func Test_checkDeprecations(t *testing.T) {
+	tests := []struct {
+		kubeVersion string
+		wantErr     string
+	}{
+		{kubeVersion: "1.20"},
+		{kubeVersion: "1.24"},
+		{
+			kubeVersion: "1.25",
+			wantErr: `APIs removed in kubernetes 1.25 are used:
+  batch/v1beta1 CronJob cleanup in templates/cronjob.yaml: removed in 1.25, use batch/v1 instead
+  policy/v1beta1 PodSecurityPolicy restricted in templates/psp.yaml: removed in 1.25`,
+		},
+		{
+			kubeVersion: "v1.26.1",
+			wantErr: `APIs removed in kubernetes 1.26 are used:
+  batch/v1beta1 CronJob cleanup in templates/cronjob.yaml: removed in 1.25, use batch/v1 instead
+  autoscaling/v2beta2 HorizontalPodAutoscaler web in templates/cronjob.yaml: removed in 1.26, use autoscaling/v2 instead
+  policy/v1beta1 PodSecurityPolicy restricted in templates/psp.yaml: removed in 1.25`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kubeVersion, func(t *testing.T) {
+			fs = afero.NewOsFs()
+
+			err := checkDeprecationsCommand("testdata/deprecated", tt.kubeVersion)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
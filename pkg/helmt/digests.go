@@ -0,0 +1,106 @@
+package helmt
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v2"
+)
+
+type imageLock struct {
+	Images map[string]string `yaml:"images"`
+}
+
+// imageLockFile returns the lock file path, which defaults to the spec file name with suffix -images.lock.
+// A relative lock file of the spec is resolved against the directory of the spec file.
+func imageLockFile(filename string, postProcess PostProcess) string {
+	if postProcess.ImageLockFile != "" {
+		if filepath.IsAbs(postProcess.ImageLockFile) {
+			return postProcess.ImageLockFile
+		}
+		return filepath.Join(filepath.Dir(filename), postProcess.ImageLockFile)
+	}
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + "-images.lock"
+}
+
+// pinImageDigestsCommand replaces the tags of all container images by the digests they are pointing to.
+// The digests are taken from the lock file if present, otherwise they are resolved using the registry.
+// The lock file is updated afterwards, so that later renders are reproducible and work offline.
+func pinImageDigestsCommand(ctx context.Context, directory, lockFile string) error {
+	lock, err := readImageLock(lockFile)
+	if err != nil {
+		return err
+	}
+
+	credentials := map[string]registryCredentials{}
+	used := map[string]string{}
+	err = replaceImagesInDirectory(directory, func(image string) (string, error) {
+		if strings.Contains(image, "@") {
+			return image, nil
+		}
+		digest, ok := lock.Images[image]
+		if !ok {
+			registry := parseImageReference(image).Registry
+			if _, ok := credentials[registry]; !ok {
+				credentials[registry], err = imageRegistryCredentials(registry)
+				if err != nil {
+					return "", err
+				}
+			}
+			digest, err = resolveDigest(ctx, image, credentials[registry])
+			if err != nil {
+				return "", fmt.Errorf("failed to resolve digest of %s: %v", image, err)
+			}
+		}
+		used[image] = digest
+		return image + "@" + digest, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	content, err := yaml.Marshal(imageLock{Images: used})
+	if err != nil {
+		return err
+	}
+	content = append([]byte("# generated by helmt, do not edit\n"), content...)
+	return afero.WriteFile(fs, lockFile, content, 0644)
+}
+
+// imageRegistryCredentials looks up the credentials of an image registry like the ones of an OCI chart repository:
+// configured repositories, credential helpers and the registry configs of helm and docker. The credentials of the
+// chart repository are never sent to image registries, no credentials are used if none are found.
+func imageRegistryCredentials(registry string) (registryCredentials, error) {
+	if registry == dockerHubRegistry {
+		// docker login stores the credentials of docker hub for its index
+		registry = dockerHubIndex
+	}
+	config, err := repositoryConfig("oci://"+registry, "", "")
+	if err != nil {
+		return registryCredentials{}, err
+	}
+	return ociCredentials(config)
+}
+
+func readImageLock(lockFile string) (*imageLock, error) {
+	lock := &imageLock{Images: map[string]string{}}
+	exists, err := afero.Exists(fs, lockFile)
+	if err != nil || !exists {
+		return lock, err
+	}
+	content, err := afero.ReadFile(fs, lockFile)
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(content, lock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", lockFile, err)
+	}
+	if lock.Images == nil {
+		lock.Images = map[string]string{}
+	}
+	return lock, nil
+}
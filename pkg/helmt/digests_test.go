@@ -0,0 +1,100 @@
+package helmt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_imageLockFile(t *testing.T) {
+	assert.Equal(t, "charts/helm-chart-images.lock", imageLockFile("charts/helm-chart.yaml", PostProcess{}))
+	assert.Equal(t, "charts/images.lock", imageLockFile("charts/helm-chart.yaml", PostProcess{ImageLockFile: "images.lock"}))
+	assert.Equal(t, "locks/images.lock", imageLockFile("charts/helm-chart.yaml", PostProcess{ImageLockFile: "../locks/images.lock"}))
+	assert.Equal(t, "/etc/helmt/images.lock", imageLockFile("charts/helm-chart.yaml", PostProcess{ImageLockFile: "/etc/helmt/images.lock"}))
+}
+
+func Test_pinImageDigests(t *testing.T) {
+	defer setEnv(t, "HELM_REGISTRY_CONFIG", "testdata/registry/missing.json")()
+	defer setEnv(t, "DOCKER_CONFIG", "testdata/registry/missing")()
+	server := newTestRegistry(t, map[string]string{
+		"team/app/manifests/1.0":    "sha256:1111",
+		"team/worker/manifests/2.0": "sha256:2222",
+	})
+	registry := strings.TrimPrefix(server.URL, "https://")
+	fs = afero.NewOsFs()
+	dir, err := ioutil.TempDir("", "digests")
+	require.NoError(t, err)
+	defer func() { _ = fs.RemoveAll(dir) }()
+	manifest := fmt.Sprintf(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: worker
+          image: %[1]s/team/worker:2.0
+      containers:
+        - name: app
+          image: %[1]s/team/app:1.0
+        - name: pinned
+          image: %[1]s/team/app@sha256:0000
+`, registry)
+	template := filepath.Join(dir, "chart/templates/deployment.yaml")
+	require.NoError(t, os.MkdirAll(filepath.Dir(template), os.ModePerm))
+	require.NoError(t, ioutil.WriteFile(template, []byte(manifest), os.ModePerm))
+	lockFile := filepath.Join(dir, "helm-chart-images.lock")
+
+	// credentials are only used for registries without matching config
+	err = pinImageDigestsCommand(context.Background(), filepath.Join(dir, "chart"), lockFile)
+	assert.EqualError(t, err, fmt.Sprintf("failed to resolve digest of %s/team/worker:2.0: request to %s/token?scope=repository%%3Ateam%%2Fworker%%3Apull&service=registry.test failed: 401 Unauthorized", registry, server.URL))
+
+	viper.Set(repositoriesKey, map[string]interface{}{
+		"oci://" + registry:      map[string]interface{}{"username": "user", "password": "pass"},
+		"oci://registry.example": map[string]interface{}{"username": "other", "password": "other"},
+	})
+	defer viper.Reset()
+	err = pinImageDigestsCommand(context.Background(), filepath.Join(dir, "chart"), lockFile)
+	require.NoError(t, err)
+
+	expected := fmt.Sprintf(`---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: worker
+          image: %[1]s/team/worker:2.0@sha256:2222
+      containers:
+        - name: app
+          image: %[1]s/team/app:1.0@sha256:1111
+        - name: pinned
+          image: %[1]s/team/app@sha256:0000`, registry)
+	assert.Equal(t, expected, ReadFileAsString(t, template))
+	assert.Equal(t, fmt.Sprintf(`# generated by helmt, do not edit
+images:
+  %[1]s/team/app:1.0: sha256:1111
+  %[1]s/team/worker:2.0: sha256:2222`, registry), ReadFileAsString(t, lockFile))
+
+	// later renders work offline using the lock file
+	server.Close()
+	require.NoError(t, ioutil.WriteFile(template, []byte(manifest), os.ModePerm))
+
+	viper.Reset()
+	err = pinImageDigestsCommand(context.Background(), filepath.Join(dir, "chart"), lockFile)
+	require.NoError(t, err)
+	assert.Equal(t, expected, ReadFileAsString(t, template))
+}
@@ -0,0 +1,236 @@
+package helmt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// externalizedAnnotation references the externalized material of a Secret stub
+	externalizedAnnotation = "helmt.syncier.com/externalized"
+	// localConfigAnnotation makes kustomize build leave out the stubs, so they never replace the real Secrets
+	localConfigAnnotation  = "config.kubernetes.io/local-config"
+	encryptedSecretsDir    = "secrets"
+	defaultMovedSecretsDir = ".secrets"
+)
+
+// ExternalizeSecrets replaces the Secrets of the rendered output by stubs which reference the externalized material.
+type ExternalizeSecrets struct {
+	// Mode is move to write the secrets into a git-ignored directory or encrypt to encrypt them with age
+	Mode string `yaml:"mode" validate:"omitempty,oneof=move encrypt"`
+	// Directory receives the moved secrets, defaults to .secrets
+	Directory string `yaml:"directory"`
+	// Recipients are the age public keys the secrets are encrypted for
+	Recipients []string `yaml:"recipients"`
+	// RecipientsFile contains additional age public keys, one per line
+	RecipientsFile string `yaml:"recipientsFile"`
+}
+
+// externalizeSecretsCommand moves or encrypts all Secrets rendered into directory and leaves stubs in their place.
+// Encrypted secrets are stored in secrets/ of the rendered chart, moved secrets in options.Directory/<chart>.
+// target is the directory the chart is moved to, the stubs reference the secrets relative to it.
+func externalizeSecretsCommand(directory, target string, options ExternalizeSecrets) error {
+	if options.Mode == "" {
+		return nil
+	}
+
+	var recipients []string
+	movedDirectory := ""
+	switch options.Mode {
+	case "encrypt":
+		var err error
+		recipients, err = readRecipients(options)
+		if err != nil {
+			return err
+		}
+		err = fs.RemoveAll(filepath.Join(directory, encryptedSecretsDir))
+		if err != nil {
+			return err
+		}
+	case "move":
+		base := options.Directory
+		if base == "" {
+			base = defaultMovedSecretsDir
+		}
+		err := ignoreDirectory(base)
+		if err != nil {
+			return err
+		}
+		movedDirectory = filepath.Join(base, filepath.Base(target))
+		err = fs.RemoveAll(movedDirectory)
+		if err != nil {
+			return err
+		}
+	}
+
+	return walkManifests(directory, func(path string, documents [][]byte) error {
+		changed := false
+		for i, document := range documents {
+			manifest, err := parseManifest(document)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", path, err)
+			}
+			if manifest["kind"] != "Secret" {
+				continue
+			}
+			// registers the secret values for redaction
+			scanManifest(manifest)
+
+			name := secretFileName(manifest)
+			var reference string
+			if options.Mode == "encrypt" {
+				encrypted, err := ageEncrypt(joinDocuments([][]byte{document}), recipients...)
+				if err != nil {
+					return fmt.Errorf("failed to encrypt secret %s: %v", name, err)
+				}
+				reference = filepath.ToSlash(filepath.Join(encryptedSecretsDir, name+".age"))
+				err = writeFile(filepath.Join(directory, reference), encrypted, 0644)
+				if err != nil {
+					return err
+				}
+			} else {
+				err = writeFile(filepath.Join(movedDirectory, name), joinDocuments([][]byte{document}), 0600)
+				if err != nil {
+					return err
+				}
+				reference, err = relativePath(target, filepath.Join(movedDirectory, name))
+				if err != nil {
+					return err
+				}
+			}
+
+			stub, err := secretStub(manifest, reference)
+			if err != nil {
+				return err
+			}
+			documents[i] = append(leadingComments(document), stub...)
+			changed = true
+		}
+		if !changed {
+			return nil
+		}
+		return afero.WriteFile(fs, path, joinDocuments(documents), 0644)
+	})
+}
+
+// relativePath returns path relative to the directory base, both are relative to the working directory or absolute.
+func relativePath(base, path string) (string, error) {
+	absoluteBase, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absoluteBase, absolutePath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func readRecipients(options ExternalizeSecrets) ([]string, error) {
+	recipients := append([]string{}, options.Recipients...)
+	if options.RecipientsFile != "" {
+		content, err := afero.ReadFile(fs, options.RecipientsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recipients: %v", err)
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				recipients = append(recipients, line)
+			}
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("encrypting secrets requires recipients or recipientsFile")
+	}
+	for _, recipient := range recipients {
+		if _, err := parseAgeRecipient(recipient); err != nil {
+			return nil, err
+		}
+	}
+	return recipients, nil
+}
+
+// ignoreDirectory creates directory with a .gitignore which ignores all of its content.
+func ignoreDirectory(directory string) error {
+	err := fs.MkdirAll(directory, 0700)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, filepath.Join(directory, ".gitignore"), []byte("# generated by helmt, secrets must not be committed\n*\n"), 0644)
+}
+
+func writeFile(path string, content []byte, perm os.FileMode) error {
+	err := fs.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, path, content, perm)
+}
+
+func secretFileName(manifest map[interface{}]interface{}) string {
+	name := fmt.Sprint(lookup(manifest, "metadata", "name"))
+	if namespace, ok := lookup(manifest, "metadata", "namespace").(string); ok && namespace != "" {
+		name = namespace + "-" + name
+	}
+	return name + ".yaml"
+}
+
+// secretStub returns a Secret without data which references the externalized material. It is marked as local
+// config, kustomize does not emit it.
+func secretStub(manifest map[interface{}]interface{}, reference string) ([]byte, error) {
+	metadata := yaml.MapSlice{{Key: "name", Value: lookup(manifest, "metadata", "name")}}
+	if namespace := lookup(manifest, "metadata", "namespace"); namespace != nil {
+		metadata = append(metadata, yaml.MapItem{Key: "namespace", Value: namespace})
+	}
+	if labels := lookup(manifest, "metadata", "labels"); labels != nil {
+		metadata = append(metadata, yaml.MapItem{Key: "labels", Value: labels})
+	}
+	annotations := map[interface{}]interface{}{}
+	if existing, ok := lookup(manifest, "metadata", "annotations").(map[interface{}]interface{}); ok {
+		for key, value := range existing {
+			annotations[key] = value
+		}
+	}
+	annotations[externalizedAnnotation] = reference
+	annotations[localConfigAnnotation] = "true"
+	metadata = append(metadata, yaml.MapItem{Key: "annotations", Value: annotations})
+
+	stub := yaml.MapSlice{
+		{Key: "apiVersion", Value: "v1"},
+		{Key: "kind", Value: "Secret"},
+		{Key: "metadata", Value: metadata},
+	}
+	if secretType := manifest["type"]; secretType != nil {
+		stub = append(stub, yaml.MapItem{Key: "type", Value: secretType})
+	}
+	return yaml.Marshal(stub)
+}
+
+// leadingComments returns the comment lines at the beginning of document, like the source comment of helm.
+func leadingComments(document []byte) []byte {
+	comments := &bytes.Buffer{}
+	scanner := bufio.NewScanner(bytes.NewReader(document))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") && strings.TrimSpace(line) != "" {
+			break
+		}
+		if strings.TrimSpace(line) != "" {
+			comments.WriteString(line + "\n")
+		}
+	}
+	return comments.Bytes()
+}
@@ -0,0 +1,150 @@
+package helmt
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const renderedSecret = `---
+# Source: app/templates/secret.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: prod
+  labels:
+    app: app
+  annotations:
+    checksum: abc
+type: Opaque
+data:
+  password: aHVudGVyMjI=
+---
+# Source: app/templates/secret.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  level: debug
+`
+
+const secretStubFormat = `---
+# Source: app/templates/secret.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  namespace: prod
+  labels:
+    app: app
+  annotations:
+    checksum: abc
+    config.kubernetes.io/local-config: "true"
+    helmt.syncier.com/externalized: %s
+type: Opaque
+---
+# Source: app/templates/secret.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  level: debug
+`
+
+func Test_externalizeSecrets(t *testing.T) {
+	tests := []struct {
+		name          string
+		target        string
+		options       ExternalizeSecrets
+		wantReference string
+		wantMoved     string
+		wantErr       string
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name:          "encrypt",
+			options:       ExternalizeSecrets{Mode: "encrypt", Recipients: []string{testAgeRecipient}},
+			wantReference: "secrets/prod-app.yaml.age",
+		},
+		{
+			name:          "encrypt with recipients file",
+			options:       ExternalizeSecrets{Mode: "encrypt", RecipientsFile: "/recipients.txt"},
+			wantReference: "secrets/prod-app.yaml.age",
+		},
+		{
+			name:    "encrypt without recipients",
+			options: ExternalizeSecrets{Mode: "encrypt"},
+			wantErr: "encrypting secrets requires recipients or recipientsFile",
+		},
+		{
+			name:    "encrypt with invalid recipient",
+			options: ExternalizeSecrets{Mode: "encrypt", Recipients: []string{"age1invalid"}},
+			wantErr: "invalid age recipient age1invalid",
+		},
+		{
+			name:          "move",
+			target:        "manifests/app",
+			options:       ExternalizeSecrets{Mode: "move"},
+			wantReference: "../../.secrets/app/prod-app.yaml",
+			wantMoved:     ".secrets/app/prod-app.yaml",
+		},
+		{
+			name:          "move to directory",
+			target:        "/work/manifests/app",
+			options:       ExternalizeSecrets{Mode: "move", Directory: "/work/plain"},
+			wantReference: "../../plain/app/prod-app.yaml",
+			wantMoved:     "/work/plain/app/prod-app.yaml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs = afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(fs, "/rendered/templates/secret.yaml", []byte(renderedSecret), 0644))
+			require.NoError(t, afero.WriteFile(fs, "/recipients.txt", []byte("# ops team\n"+testAgeRecipient+"\n"), 0644))
+
+			target := tt.target
+			if target == "" {
+				target = "app"
+			}
+			err := externalizeSecretsCommand("/rendered", target, tt.options)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			content, err := afero.ReadFile(fs, "/rendered/templates/secret.yaml")
+			require.NoError(t, err)
+			if tt.wantReference == "" {
+				assert.Equal(t, renderedSecret, string(content))
+				return
+			}
+			assert.Equal(t, fmt.Sprintf(secretStubFormat, tt.wantReference), string(content))
+
+			var plaintext []byte
+			if tt.options.Mode == "encrypt" {
+				encrypted, err := afero.ReadFile(fs, "/rendered/"+tt.wantReference)
+				require.NoError(t, err)
+				plaintext, err = ageDecrypt(encrypted, readTestAgeIdentities(t))
+				require.NoError(t, err)
+			} else {
+				plaintext, err = afero.ReadFile(fs, tt.wantMoved)
+				require.NoError(t, err)
+				ignore, err := afero.ReadFile(fs, filepath.Join(filepath.Dir(filepath.Dir(tt.wantMoved)), ".gitignore"))
+				require.NoError(t, err)
+				assert.Contains(t, string(ignore), "*\n")
+			}
+			assert.Contains(t, string(plaintext), "password: aHVudGVyMjI=")
+			assert.Contains(t, string(plaintext), "# Source: app/templates/secret.yaml")
+		})
+	}
+}
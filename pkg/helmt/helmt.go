@@ -1,20 +1,18 @@
 package helmt
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/fatih/color"
 	"github.com/go-playground/validator/v10"
 	"github.com/spf13/afero"
-	"github.com/spf13/viper"
 	"gopkg.in/yaml.v2"
 )
 
@@ -23,6 +21,21 @@ var (
 	Error                 = color.Error
 	execute               = execCommand
 	generateKustomization = generateKustomizationCommand
+	generateNamespace     = generateNamespaceCommand
+	separateCRDs          = separateCRDsCommand
+	generateUmbrella      = generateUmbrellaKustomizationCommand
+	writeImageInventory   = writeImageInventoryCommand
+	rewriteImages         = rewriteImagesCommand
+	pinImageDigests       = pinImageDigestsCommand
+	validateManifests     = validateManifestsCommand
+	checkDeprecations     = checkDeprecationsCommand
+	checkPolicies         = checkPoliciesCommand
+	scanSecrets           = scanSecretsCommand
+	externalizeSecrets    = externalizeSecretsCommand
+	decryptValues         = decryptValuesCommand
+	verifyChart           = verifyChartCommand
+	fetch                 = fetchCommand
+	extractChartFiles     = extractChartFilesCommand
 	TempDir               = afero.TempDir
 	// use a single instance of Validate, it caches struct info
 	validate *validator.Validate = validator.New()
@@ -30,20 +43,47 @@ var (
 )
 
 type HelmChart struct {
-	Chart       string      `yaml:"chart" validate:"required"`
-	Version     string      `yaml:"version" validate:"required"`
-	Repository  string      `yaml:"repository" validate:"required"`
-	Name        string      `yaml:"name" validate:"required"`
-	Namespace   string      `yaml:"namespace"`
-	Values      []string    `yaml:"values"`
-	SkipCRDs    bool        `yaml:"skipCRDs"`
-	PostProcess PostProcess `yaml:"postProcess"`
-	OutputDir   string      `yaml:"outputDir"`
-	ApiVersions []string    `yaml:"apiVersions"`
+	Chart                string            `yaml:"chart" validate:"required"`
+	Version              string            `yaml:"version" validate:"required"`
+	Repository           string            `yaml:"repository" validate:"required"`
+	Name                 string            `yaml:"name" validate:"required"`
+	Namespace            string            `yaml:"namespace" validate:"required_if=CreateNamespace true"`
+	CreateNamespace      bool              `yaml:"createNamespace"`
+	NamespaceLabels      map[string]string `yaml:"namespaceLabels"`
+	NamespaceAnnotations map[string]string `yaml:"namespaceAnnotations"`
+	Values               []string          `yaml:"values"`
+	SkipCRDs             bool              `yaml:"skipCRDs"`
+	PostProcess          PostProcess       `yaml:"postProcess"`
+	OutputDir            string            `yaml:"outputDir"`
+	ApiVersions          []string          `yaml:"apiVersions"`
+	KubeVersion          string            `yaml:"kubeVersion"`
+	Capabilities         string            `yaml:"capabilities"`
+	// CAFile, CertFile, KeyFile, InsecureSkipTLSVerify and PassCredentials overwrite the settings of the repository
+	CAFile                string       `yaml:"caFile"`
+	CertFile              string       `yaml:"certFile"`
+	KeyFile               string       `yaml:"keyFile"`
+	InsecureSkipTLSVerify bool         `yaml:"insecureSkipTLSVerify"`
+	PassCredentials       bool         `yaml:"passCredentials"`
+	Verify                Verification `yaml:"verify"`
+	// Digest pins the sha256 digest of the chart package, e.g. sha256:e3b0c442...
+	Digest string `yaml:"digest" validate:"omitempty,startswith=sha256:,len=71"`
 }
 
 type PostProcess struct {
-	GenerateKustomization bool `yaml:"generateKustomization"`
+	GenerateKustomization bool               `yaml:"generateKustomization"`
+	Kustomization         Kustomization      `yaml:"kustomization"`
+	UmbrellaKustomization bool               `yaml:"umbrellaKustomization"`
+	SeparateCRDs          bool               `yaml:"separateCRDs"`
+	ImageInventory        bool               `yaml:"imageInventory"`
+	ImageRewrites         []ImageRewriteRule `yaml:"imageRewrites" validate:"dive"`
+	PinImageDigests       bool               `yaml:"pinImageDigests"`
+	ImageLockFile         string             `yaml:"imageLockFile"`
+	Validate              Validation         `yaml:"validate"`
+	Policies              Policies           `yaml:"policies"`
+	SecretScan            SecretScan         `yaml:"secretScan"`
+	ExternalizeSecrets    ExternalizeSecrets `yaml:"externalizeSecrets"`
+	// ChartFiles are copied from the chart package into the rendered chart
+	ChartFiles []string `yaml:"chartFiles" validate:"dive,oneof=values.yaml README.md values.schema.json"`
 }
 
 func readParameters(filename string) (*HelmChart, error) {
@@ -61,74 +101,287 @@ func readParameters(filename string) (*HelmChart, error) {
 	if err != nil {
 		return nil, err
 	}
+	// the umbrella kustomization only references charts with a kustomization.yaml
+	if chart.PostProcess.UmbrellaKustomization && !chart.PostProcess.GenerateKustomization {
+		return nil, fmt.Errorf("postProcess.umbrellaKustomization requires postProcess.generateKustomization")
+	}
 	return chart, nil
 }
 
-func HelmTemplate(filename, username, password string) error {
+// temporaryDirectories holds the temporary directories of running renderings, they contain decrypted values.
+var temporaryDirectories = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// RemoveTemporaryDirectories removes the temporary directories of all running renderings. It is called before helmt
+// exits without returning from HelmTemplate, e.g. on a second SIGINT.
+func RemoveTemporaryDirectories() {
+	temporaryDirectories.Lock()
+	defer temporaryDirectories.Unlock()
+	for path := range temporaryDirectories.paths {
+		_ = fs.RemoveAll(path)
+		delete(temporaryDirectories.paths, path)
+	}
+}
+
+// HelmTemplate renders the chart described in filename. Canceling ctx, e.g. on SIGINT, stops helm and the downloads,
+// the temporary directory is removed in any case.
+func HelmTemplate(ctx context.Context, filename, username, password string) error {
 	tmpDir, err := TempDir(fs, ".", "helmt")
 	if err != nil {
 		return fmt.Errorf("failed to create temporary directory: %v", err)
 	}
-	defer func() { _ = fs.RemoveAll(tmpDir) }()
+	temporaryDirectories.Lock()
+	temporaryDirectories.paths[tmpDir] = true
+	temporaryDirectories.Unlock()
+	defer func() {
+		temporaryDirectories.Lock()
+		defer temporaryDirectories.Unlock()
+		delete(temporaryDirectories.paths, tmpDir)
+		_ = fs.RemoveAll(tmpDir)
+	}()
 
 	chart, err := readParameters(filename)
 	if err != nil {
 		return err
 	}
 
+	err = expandCapabilities(chart)
+	if err != nil {
+		return err
+	}
+
 	err = HelmVersion()
 	if err != nil {
 		return err
 	}
 
-	chartFile, err := fetch(tmpDir, chart.Repository, chart.Chart, chart.Version, username, password)
+	repository, err := repositoryConfig(chart.Repository, username, password)
 	if err != nil {
 		return err
 	}
+	repository = applyChartTLS(repository, chart)
 
-	err = template(tmpDir, chart.Name, filepath.Join(tmpDir, chartFile), chart.Values, chart.Namespace, chart.SkipCRDs, chart.ApiVersions)
+	verification, err := mergeVerification(chart.Verify)
 	if err != nil {
 		return err
 	}
 
-	err = downloadChartMetadata(tmpDir, chart.Chart, chart.Repository, chart.Version)
+	var chartFile string
+	var provenance *verificationResult
+	err = withTimeout(ctx, "fetch", FetchTimeoutFlag, func(ctx context.Context) error {
+		chartFile, err = fetch(ctx, tmpDir, chart.Repository, chart.Chart, chart.Version, repository, verification.Mode != verifyOff)
+		if err != nil {
+			return err
+		}
+		if chart.Digest != "" {
+			err = checkChartDigest(filepath.Join(tmpDir, chartFile), chart.Digest)
+			if err != nil {
+				return err
+			}
+		}
+		provenance, err = verifyChart(ctx, tmpDir, chartFile, chart, repository, verification)
+		return err
+	})
 	if err != nil {
-		println(fmt.Sprintf("Warning: Could not retrieve Chart.yaml (%v)", err))
+		return err
+	}
+
+	values, err := decryptValues(tmpDir, chart.Values)
+	if err != nil {
+		return err
+	}
+
+	err = withTimeout(ctx, "helm template", TemplateTimeoutFlag, func(ctx context.Context) error {
+		return template(ctx, tmpDir, chart.Name, filepath.Join(tmpDir, chartFile), values, chart.Namespace, chart.SkipCRDs, chart.ApiVersions, chart.KubeVersion)
+	})
+	if err != nil {
+		return err
 	}
 
 	rendered := filepath.Join(tmpDir, chart.Chart)
 
+	err = writeChartMetadata(filepath.Join(tmpDir, chartFile), rendered)
+	if err != nil {
+		return fmt.Errorf("failed to write Chart.yaml: %v", err)
+	}
+
+	if chart.CreateNamespace {
+		err = generateNamespace(rendered, chart.Namespace, chart.NamespaceLabels, chart.NamespaceAnnotations)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(chart.PostProcess.ImageRewrites) > 0 {
+		err = rewriteImages(rendered, chart.PostProcess.ImageRewrites)
+		if err != nil {
+			return fmt.Errorf("failed to rewrite images: %v", err)
+		}
+	}
+
+	if chart.PostProcess.PinImageDigests {
+		err = pinImageDigests(ctx, rendered, imageLockFile(filename, chart.PostProcess))
+		if err != nil {
+			return fmt.Errorf("failed to pin image digests: %v", err)
+		}
+	}
+
+	if chart.KubeVersion != "" {
+		err = checkDeprecations(rendered, chart.KubeVersion)
+		if err != nil {
+			return err
+		}
+	}
+
+	if chart.PostProcess.Validate.Enabled {
+		validation := chart.PostProcess.Validate
+		if validation.KubeVersion == "" {
+			validation.KubeVersion = chart.KubeVersion
+		}
+		err = validateManifests(rendered, validation)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = checkPolicies(rendered, outputTarget(chart), chart.PostProcess.Policies)
+	if err != nil {
+		return err
+	}
+
+	err = externalizeSecrets(rendered, outputTarget(chart), chart.PostProcess.ExternalizeSecrets)
+	if err != nil {
+		return err
+	}
+
+	err = scanSecrets(rendered, chart.PostProcess.SecretScan)
+	if err != nil {
+		return err
+	}
+
+	renderedCRDs := rendered + "-crds"
+	if chart.PostProcess.SeparateCRDs {
+		err = separateCRDs(rendered, renderedCRDs)
+		if err != nil {
+			return fmt.Errorf("failed to separate CRDs: %v", err)
+		}
+	}
+
+	if chart.PostProcess.ImageInventory {
+		err = writeImageInventory(rendered)
+		if err != nil {
+			return fmt.Errorf("failed to write image inventory: %v", err)
+		}
+	}
+
+	err = writeOutputMetadata(rendered, chart, provenance)
+	if err != nil {
+		return err
+	}
+
+	target := outputTarget(chart)
+
 	if chart.PostProcess.GenerateKustomization {
-		err = generateKustomization(rendered)
+		err = generateKustomization(rendered, chart.PostProcess.Kustomization)
+		if err != nil {
+			return err
+		}
+		err = preserveKustomizations(rendered, target)
 		if err != nil {
 			return err
 		}
 	}
 
+	// extracted after post-processing and generating the kustomization, so that values.yaml is not mistaken for a manifest
+	if len(chart.PostProcess.ChartFiles) > 0 {
+		err = extractChartFiles(filepath.Join(tmpDir, chartFile), rendered, chart.PostProcess.ChartFiles)
+		if err != nil {
+			return fmt.Errorf("failed to extract chart files: %v", err)
+		}
+	}
+
+	err = moveRendered(rendered, target)
+	if err != nil {
+		return fmt.Errorf("failed to move rendered chart: %v", err)
+	}
+
+	if chart.PostProcess.SeparateCRDs {
+		err = moveSeparatedCRDs(renderedCRDs, target+"-crds", chart, provenance)
+		if err != nil {
+			return err
+		}
+	}
+
+	if chart.PostProcess.UmbrellaKustomization {
+		err = generateUmbrella(filepath.Dir(target))
+		if err != nil {
+			return fmt.Errorf("failed to generate umbrella kustomization: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// outputTarget returns the directory the chart is rendered into.
+func outputTarget(chart *HelmChart) string {
 	target := "."
 	if chart.OutputDir != "" {
 		target = chart.OutputDir
 	}
-	target = filepath.Join(target, chart.Chart)
+	return filepath.Join(target, chart.Chart)
+}
 
-	err = fs.RemoveAll(target)
+// moveSeparatedCRDs moves the separated CRDs next to the rendered chart.
+// An outdated CRD directory is removed, even if the chart does not contain any CRDs anymore.
+func moveSeparatedCRDs(renderedCRDs, target string, chart *HelmChart, provenance *verificationResult) error {
+	exists, err := afero.DirExists(fs, renderedCRDs)
 	if err != nil {
 		return err
 	}
-
-	err = fs.Rename(rendered, target)
+	if !exists {
+		return fs.RemoveAll(target)
+	}
+	err = writeOutputMetadata(renderedCRDs, chart, provenance)
 	if err != nil {
-		return fmt.Errorf("failed to move rendered chart: %v", err)
+		return err
+	}
+	if chart.PostProcess.GenerateKustomization {
+		// the options of the chart would rename the CRDs and refer to patches of the chart directory
+		err = generateKustomization(renderedCRDs, Kustomization{})
+		if err != nil {
+			return err
+		}
+		err = preserveKustomizations(renderedCRDs, target)
+		if err != nil {
+			return err
+		}
+	}
+	err = moveRendered(renderedCRDs, target)
+	if err != nil {
+		return fmt.Errorf("failed to move rendered CRDs: %v", err)
 	}
-
 	return nil
 }
 
+func moveRendered(rendered, target string) error {
+	err := fs.RemoveAll(target)
+	if err != nil {
+		return err
+	}
+	err = fs.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	return fs.Rename(rendered, target)
+}
+
 func HelmVersion() error {
 	return execute("helm", execOpts{}, "version")
 }
 
-func template(tmpDir, name, chart string, values []string, namespace string, skipCRDs bool, ApiVersions []string) error {
+func template(ctx context.Context, tmpDir, name, chart string, values []string, namespace string, skipCRDs bool, ApiVersions []string, kubeVersion string) error {
 	args := []string{"template", name, chart}
 	if len(namespace) > 0 {
 		args = append(args, "--namespace", namespace)
@@ -146,43 +399,27 @@ func template(tmpDir, name, chart string, values []string, namespace string, ski
 			args = append(args, "--api-versions", apiversion)
 		}
 	}
+	if kubeVersion != "" {
+		args = append(args, "--kube-version", kubeVersion)
+	}
 
-	err := execute("helm", execOpts{}, args...)
+	err := execute("helm", execOpts{Context: ctx}, args...)
 	if err != nil {
 		return fmt.Errorf("helm template failed: %v", err)
 	}
 	return nil
 }
 
-func fetch(tmpDir, repository, chart, version, username, password string) (string, error) {
-	isOCI := strings.HasPrefix(repository, "oci://")
-	if isOCI {
-		repository = strings.Join([]string{repository, chart}, "/")
-	}
-
-	args := []string{"fetch"}
-	if !isOCI {
-		args = append(args, "--repo")
-	}
-	args = append(args, repository)
-	args = append(args, "--version", version)
-	args = append(args, "--destination", tmpDir)
-	if username != "" {
-		args = append(args, "--username", username)
-	}
-	if password != "" {
-		args = append(args, "--password", password)
-	}
-
-	if !isOCI {
-		args = append(args, chart)
-	}
-	err := execute("helm", execOpts{}, args...)
-	if err != nil {
-		return "", err
+// fetchCommand downloads the chart into tmpDir, helm is not involved. With provenance, the provenance file of charts
+// of HTTP repositories is downloaded as well.
+func fetchCommand(ctx context.Context, tmpDir, repository, chart, version string, config Repository, provenance bool) (string, error) {
+	var result string
+	var err error
+	if strings.HasPrefix(repository, "oci://") {
+		result, err = pullChart(ctx, tmpDir, repository, chart, version, config)
+	} else {
+		result, err = downloadChart(ctx, tmpDir, repository, chart, version, config, provenance)
 	}
-
-	result, err := findChartPackage(tmpDir)
 	if err != nil {
 		return "", err
 	}
@@ -191,99 +428,28 @@ func fetch(tmpDir, repository, chart, version, username, password string) (strin
 }
 
 type execOpts struct {
-	Dir    string
-	Output io.Writer
+	// Context kills the command when it is done, defaults to context.Background()
+	Context context.Context
+	Dir     string
+	Output  io.Writer
+	Stdin   io.Reader
 }
 
 func execCommand(name string, opts execOpts, arg ...string) error {
-	args := strings.Join(arg, " ")
-	args = strings.ReplaceAll(args, "--password "+viper.GetString("password"), "--password *****")
-	color.Magenta("%s %s", name, args)
+	color.Magenta("%s %s", name, redactions.redact(strings.Join(arg, " ")))
 
-	command := exec.Command(name, arg...)
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	command := exec.CommandContext(ctx, name, arg...)
 	command.Dir = opts.Dir
+	command.Stdin = opts.Stdin
 	if opts.Output != nil {
 		command.Stdout = opts.Output
 	} else {
-		command.Stdout = Output
+		command.Stdout = redactingWriter{Output}
 	}
-	command.Stderr = Error
+	command.Stderr = redactingWriter{Error}
 	return command.Run()
 }
-
-func generateKustomizationCommand(directory string) error {
-	kustomization, err := fs.Create(path.Join(directory, "kustomization.yaml"))
-	if err != nil {
-		return err
-	}
-	defer func() { _ = kustomization.Close() }()
-
-	_, err = kustomization.WriteString(`apiVersion: kustomize.config.k8s.io/v1beta1
-kind: Kustomization
-resources:
-`)
-	if err != nil {
-		return err
-	}
-
-	err = afero.Walk(fs, directory, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		rel, err := filepath.Rel(directory, path)
-		if err != nil {
-			return err
-		}
-		if rel == "kustomization.yaml" {
-			return nil
-		}
-
-		_, err = kustomization.WriteString(fmt.Sprintf("  - %s\n", rel))
-		if err != nil {
-			return err
-		}
-		return nil
-	})
-
-	return err
-}
-
-func findChartPackage(dir string) (string, error) {
-	c, err := afero.ReadDir(fs, dir)
-	if err != nil {
-		return "", err
-	}
-	for _, f := range c {
-		if filepath.Ext(f.Name()) == ".tgz" {
-			return f.Name(), nil
-		}
-	}
-	return "", fmt.Errorf("unexpected content in temporary directory %v", dir)
-}
-
-func downloadChartMetadata(tmpDir, chart, repo, version string) error {
-	isOCI := strings.HasPrefix(repo, "oci://")
-	args := []string{"show", "chart"}
-	if !isOCI {
-		args = append(args, chart, "--repo")
-	}
-	if isOCI {
-		repo = strings.Join([]string{repo, chart}, "/")
-	}
-	args = append(args, repo, "--version", version)
-
-	output := &bytes.Buffer{}
-	// Due to https://github.com/helm/helm/issues/6864 we have to run the command in another directory.
-	// Otherwise the local directory with the chart name will be taken by helm, instead of downloading from the remote repo.
-	err := execute("helm", execOpts{Dir: os.TempDir(), Output: output}, args...)
-	if err != nil {
-		return err
-	}
-
-	targetPath := filepath.Join(tmpDir, chart, "Chart.yaml")
-
-	return ioutil.WriteFile(targetPath, output.Bytes(), os.ModePerm)
-}
@@ -1,18 +1,21 @@
 package helmt
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 
-	"github.com/otiai10/copy"
 	"github.com/spf13/afero"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
 )
 
 func NewTestExecutor(t *testing.T) *testExecutor {
@@ -25,7 +28,13 @@ type testExecutor struct {
 }
 
 func (e *testExecutor) execCommand(name string, opts execOpts, arg ...string) error {
-	e.commands = append(e.commands, strings.Join(append([]string{name}, arg...), " "))
+	command := strings.Join(append([]string{name}, arg...), " ")
+	if opts.Stdin != nil {
+		input, err := ioutil.ReadAll(opts.Stdin)
+		require.NoError(e.t, err)
+		command += " < " + string(input)
+	}
+	e.commands = append(e.commands, command)
 	return nil
 }
 
@@ -84,6 +93,13 @@ func Test_readParameters(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "umbrella kustomization without kustomization",
+			args: args{
+				filename: "testdata/helm-chart-umbrella-without-kustomization.yaml",
+			},
+			wantErr: true,
+		},
 		{
 			name: "missing version",
 			args: args{
@@ -152,6 +168,52 @@ func Test_readParameters(t *testing.T) {
 				PostProcess: PostProcess{GenerateKustomization: true},
 			},
 		},
+		{
+			name: "create namespace",
+			args: args{
+				filename: "testdata/helm-chart-create-namespace.yaml",
+			},
+			want: &HelmChart{
+				Chart:                "jenkins",
+				Version:              "2.0.0",
+				Repository:           "https://kubernetes-charts.storage.googleapis.com",
+				Name:                 "jenkins",
+				Namespace:            "jenkins",
+				CreateNamespace:      true,
+				NamespaceLabels:      map[string]string{"team": "platform"},
+				NamespaceAnnotations: map[string]string{"owner": "platform@syncier.com"},
+			},
+		},
+		{
+			name: "create namespace without namespace",
+			args: args{
+				filename: "testdata/helm-chart-create-namespace-missing-namespace.yaml",
+			},
+			wantErr: true,
+		},
+		{
+			name: "image rewrites",
+			args: args{
+				filename: "testdata/helm-chart-image-rewrites.yaml",
+			},
+			want: &HelmChart{
+				Chart:      "jenkins",
+				Version:    "2.0.0",
+				Repository: "https://kubernetes-charts.storage.googleapis.com",
+				Name:       "jenkins",
+				PostProcess: PostProcess{ImageRewrites: []ImageRewriteRule{
+					{From: "docker.io/", To: "mirror.local/dockerhub/"},
+					{From: "quay.io/", To: "mirror.local/quay/"},
+				}},
+			},
+		},
+		{
+			name: "image rewrite without target",
+			args: args{
+				filename: "testdata/helm-chart-image-rewrites-invalid.yaml",
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -176,9 +238,24 @@ func TestHelmTemplate(t *testing.T) {
 	tests := []struct {
 		name                      string
 		releaseName               string
+		configFile                string
 		args                      args
 		expectedCommands          []string
 		wantGenerateKustomization bool
+		wantGenerateNamespace     bool
+		wantSeparateCRDs          bool
+		wantUmbrella              string
+		wantImageInventory        bool
+		wantImageRewrites         []ImageRewriteRule
+		wantImageLockFile         string
+		wantValidation            Validation
+		wantDeprecationsChecked   string
+		wantPolicies              Policies
+		wantSecretScan            SecretScan
+		wantExternalizeSecrets    ExternalizeSecrets
+		wantRepository            Repository
+		wantChartFiles            []string
+		wantVerification          Verification
 		wantErr                   bool
 	}{
 		{
@@ -189,9 +266,7 @@ func TestHelmTemplate(t *testing.T) {
 			},
 			expectedCommands: []string{
 				"helm version",
-				"helm fetch --repo https://kubernetes-charts.storage.googleapis.com --version 2.0.0 --destination /temp/helmt-123 jenkins",
 				"helm template something /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
-				"helm show chart jenkins --repo https://kubernetes-charts.storage.googleapis.com --version 2.0.0",
 			},
 		},
 		{
@@ -202,9 +277,7 @@ func TestHelmTemplate(t *testing.T) {
 			},
 			expectedCommands: []string{
 				"helm version",
-				"helm fetch --repo https://hub.syncier.cloud/chartrepo/library --version 5.6.0 --destination /temp/helmt-123 syncier-jenkins",
 				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --namespace jenkins --include-crds --skip-tests --values values1.yaml --values values2.yaml --output-dir /temp/helmt-123",
-				"helm show chart syncier-jenkins --repo https://hub.syncier.cloud/chartrepo/library --version 5.6.0",
 			},
 		},
 		{
@@ -224,9 +297,7 @@ func TestHelmTemplate(t *testing.T) {
 			},
 			expectedCommands: []string{
 				"helm version",
-				"helm fetch --repo https://kubernetes-charts.storage.googleapis.com --version 2.1.0 --destination /temp/helmt-123 jenkins",
 				"helm template something /temp/helmt-123/chart-1.0.0.tgz --skip-tests --output-dir /temp/helmt-123",
-				"helm show chart jenkins --repo https://kubernetes-charts.storage.googleapis.com --version 2.1.0",
 			},
 		},
 		{
@@ -237,9 +308,7 @@ func TestHelmTemplate(t *testing.T) {
 			},
 			expectedCommands: []string{
 				"helm version",
-				"helm fetch --repo https://kubernetes-charts.storage.googleapis.com --version 8.12.15 --destination /temp/helmt-123 prometheus-operator",
 				"helm template agent-prometheus /temp/helmt-123/chart-1.0.0.tgz --namespace infra-monitoring --include-crds --skip-tests --values prometheus-operator-values.yaml --output-dir /temp/helmt-123",
-				"helm show chart prometheus-operator --repo https://kubernetes-charts.storage.googleapis.com --version 8.12.15",
 			},
 			wantGenerateKustomization: true,
 		},
@@ -251,9 +320,7 @@ func TestHelmTemplate(t *testing.T) {
 			},
 			expectedCommands: []string{
 				"helm version",
-				"helm fetch --repo https://hub.syncier.cloud/chartrepo/library --version 5.6.0 --destination /temp/helmt-123 syncier-jenkins",
 				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --namespace jenkins --include-crds --skip-tests --values values1.yaml --values values2.yaml --output-dir /temp/helmt-123",
-				"helm show chart syncier-jenkins --repo https://hub.syncier.cloud/chartrepo/library --version 5.6.0",
 			},
 			wantGenerateKustomization: false,
 		},
@@ -265,9 +332,7 @@ func TestHelmTemplate(t *testing.T) {
 			},
 			expectedCommands: []string{
 				"helm version",
-				"helm fetch --repo https://hub.syncier.cloud/chartrepo/library --version 5.6.0 --destination /temp/helmt-123 syncier-jenkins",
 				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --namespace jenkins --include-crds --skip-tests --values values1.yaml --values values2.yaml --output-dir /temp/helmt-123 --api-versions monitoring.coreos.com/v1 --api-versions monitoring.coreos.com/v1alpha1",
-				"helm show chart syncier-jenkins --repo https://hub.syncier.cloud/chartrepo/library --version 5.6.0",
 			},
 			wantGenerateKustomization: false,
 		},
@@ -281,10 +346,9 @@ func TestHelmTemplate(t *testing.T) {
 			},
 			expectedCommands: []string{
 				"helm version",
-				"helm fetch --repo https://kubernetes-charts.storage.googleapis.com --version 2.0.0 --destination /temp/helmt-123 --username user --password pass jenkins",
 				"helm template something /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
-				"helm show chart jenkins --repo https://kubernetes-charts.storage.googleapis.com --version 2.0.0",
 			},
+			wantRepository: Repository{Username: "user", Password: "pass"},
 		},
 		{
 			name:        "helm template using OCI repo format",
@@ -294,233 +358,578 @@ func TestHelmTemplate(t *testing.T) {
 			},
 			expectedCommands: []string{
 				"helm version",
-				"helm fetch oci://acrsycprodfrc1platform.azurecr.io/charts/syncier-jenkins --version 8.8.3 --destination /temp/helmt-123",
 				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
-				"helm show chart oci://acrsycprodfrc1platform.azurecr.io/charts/syncier-jenkins --version 8.8.3",
+			},
+		},
+		{
+			name:        "helm template using OCI repo with credentials",
+			releaseName: "syncier-jenkins",
+			args: args{
+				filename: "testdata/helm-chart-oci-repo.yaml",
+				username: "user",
+				password: "pass",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantRepository: Repository{Username: "user", Password: "pass"},
+		},
+		{
+			name:        "create namespace",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-create-namespace.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --namespace jenkins --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantGenerateNamespace: true,
+		},
+		{
+			name:        "separate crds",
+			releaseName: "prometheus-operator",
+			args: args{
+				filename: "testdata/helm-chart-separate-crds.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template agent-prometheus /temp/helmt-123/chart-1.0.0.tgz --namespace infra-monitoring --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantGenerateKustomization: true,
+			wantSeparateCRDs:          true,
+		},
+		{
+			name:        "umbrella kustomization",
+			releaseName: "syncier-jenkins",
+			args: args{
+				filename: "testdata/helm-chart-umbrella.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --namespace jenkins --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantGenerateKustomization: true,
+			wantUmbrella:              "manifests",
+		},
+		{
+			name:        "image inventory",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-image-inventory.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantImageInventory: true,
+		},
+		{
+			name:        "image rewrites",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-image-rewrites.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantImageRewrites: []ImageRewriteRule{
+				{From: "docker.io/", To: "mirror.local/dockerhub/"},
+				{From: "quay.io/", To: "mirror.local/quay/"},
+			},
+		},
+		{
+			name:        "pin image digests",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-pin-image-digests.yaml",
+				username: "user",
+				password: "pass",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantImageLockFile: "testdata/helm-chart-pin-image-digests-images.lock",
+			wantRepository:    Repository{Username: "user", Password: "pass"},
+		},
+		{
+			name:        "validate manifests",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-validate.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantValidation: Validation{Enabled: true, KubeVersion: "1.21.0", SchemaDirs: []string{"schemas"}},
+		},
+		{
+			name:        "kube version",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-kube-version.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123 --kube-version 1.22.0",
+			},
+			wantValidation:          Validation{Enabled: true, KubeVersion: "1.22.0", SchemaDirs: []string{"schemas"}},
+			wantDeprecationsChecked: "1.22.0",
+		},
+		{
+			name:        "capabilities profile",
+			releaseName: "jenkins",
+			configFile:  "testdata/helmt-config.yaml",
+			args: args{
+				filename: "testdata/helm-chart-capabilities.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123 --api-versions monitoring.coreos.com/v1 --api-versions apps/v1 --api-versions networking.k8s.io/v1 --api-versions v1 --kube-version 1.21.5",
+			},
+			wantDeprecationsChecked: "1.21.5",
+		},
+		{
+			name:        "policies",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-policies.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantPolicies: Policies{
+				Enabled:           boolPtr(true),
+				Format:            "sarif",
+				AllowedRegistries: []string{"mirror.example.com/"},
+				Rules:             map[string]string{"latest-tag": "error"},
+			},
+		},
+		{
+			name:        "secret scan",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-secret-scan.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantSecretScan: SecretScan{Enabled: boolPtr(true), Mode: "warn"},
+		},
+		{
+			name:        "repository from config",
+			releaseName: "jenkins",
+			configFile:  "testdata/helmt-config.yaml",
+			args: args{
+				filename: "testdata/helm-chart-repository-config.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantRepository: Repository{Username: "reader", Password: "public-read"},
+		},
+		{
+			name:        "tls options",
+			releaseName: "jenkins",
+			configFile:  "testdata/helmt-config.yaml",
+			args: args{
+				filename: "testdata/helm-chart-tls.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantRepository: Repository{
+				CAFile:                "certs/internal-ca.pem",
+				CertFile:              "certs/client.pem",
+				KeyFile:               "certs/client-key.pem",
+				InsecureSkipTLSVerify: true,
+				PassCredentials:       true,
+			},
+		},
+		{
+			name:        "verify provenance",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-verify.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantVerification: Verification{Mode: "enforce", Keyring: "keys/pubring.gpg"},
+		},
+		{
+			name:        "pinned digest",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-digest.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+		},
+		{
+			name:        "pinned digest mismatch",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-digest-mismatch.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+			},
+			wantErr: true,
+		},
+		{
+			name:        "chart files",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-chart-files.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantChartFiles: []string{"values.yaml", "values.schema.json"},
+		},
+		{
+			name:        "encrypted values",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-encrypted-values.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --values values.yaml --values /temp/helmt-123/.decrypted-values/1-secrets.sops.yaml --output-dir /temp/helmt-123",
+			},
+		},
+		{
+			name:        "externalize secrets",
+			releaseName: "jenkins",
+			args: args{
+				filename: "testdata/helm-chart-externalize-secrets.yaml",
+			},
+			expectedCommands: []string{
+				"helm version",
+				"helm template jenkins /temp/helmt-123/chart-1.0.0.tgz --include-crds --skip-tests --output-dir /temp/helmt-123",
+			},
+			wantExternalizeSecrets: ExternalizeSecrets{
+				Mode:       "encrypt",
+				Recipients: []string{"age190uzqvjyhf0l4umjj6sx6p75hwtu4pplk3eufv20u5nlqrxgdq9qeh5pav"},
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			if tt.configFile != "" {
+				require.NoError(t, MergeConfigFile(tt.configFile))
+				defer viper.Reset()
+			}
 			executor := NewTestExecutor(t)
 			execute = executor.execCommand
 			fs = afero.NewMemMapFs()
+			if tt.configFile != "" {
+				// files referenced by the config are read through fs
+				apiVersions, err := ioutil.ReadFile("testdata/prod-cluster-api-versions.txt")
+				require.NoError(t, err)
+				require.NoError(t, afero.WriteFile(fs, "testdata/prod-cluster-api-versions.txt", apiVersions, os.ModePerm))
+			}
 			require.NoError(t, fs.Mkdir("/temp/helmt-123", os.ModePerm))
-			require.NoError(t, afero.WriteFile(fs, "/temp/helmt-123/chart-1.0.0.tgz", nil, os.ModePerm))
+			require.NoError(t, afero.WriteFile(fs, "/temp/helmt-123/chart-1.0.0.tgz", newTestChartPackage(t, tt.releaseName, map[string]string{
+				"Chart.yaml": "apiVersion: v2\nname: " + tt.releaseName,
+			}), os.ModePerm))
 			require.NoError(t, afero.WriteFile(fs, fmt.Sprintf("/temp/helmt-123/%s", tt.releaseName), nil, os.ModePerm))
 			TempDir = func(fs afero.Fs, dir, prefix string) (name string, err error) {
 				return "/temp/helmt-123", nil
 			}
 
 			kustomizationGenerated := false
-			generateKustomization = func(directory string) error {
+			generateKustomization = func(directory string, options Kustomization) error {
 				kustomizationGenerated = true
 				return nil
 			}
+			crdsSeparated := false
+			separateCRDs = func(directory, crdsDirectory string) error {
+				crdsSeparated = true
+				return nil
+			}
+			umbrella := ""
+			generateUmbrella = func(outputDir string) error {
+				umbrella = outputDir
+				return nil
+			}
+			imageInventoryWritten := false
+			writeImageInventory = func(directory string) error {
+				imageInventoryWritten = true
+				return nil
+			}
+			var imageRewrites []ImageRewriteRule
+			rewriteImages = func(directory string, rules []ImageRewriteRule) error {
+				imageRewrites = rules
+				return nil
+			}
+			imageLockFile := ""
+			pinImageDigests = func(ctx context.Context, directory, lockFile string) error {
+				imageLockFile = lockFile
+				return nil
+			}
+			validation := Validation{}
+			validateManifests = func(directory string, options Validation) error {
+				validation = options
+				return nil
+			}
+			deprecationsChecked := ""
+			checkDeprecations = func(directory, version string) error {
+				deprecationsChecked = version
+				return nil
+			}
+			policies := Policies{}
+			checkPolicies = func(directory, target string, options Policies) error {
+				policies = options
+				return nil
+			}
+			secretScan := SecretScan{}
+			scanSecrets = func(directory string, options SecretScan) error {
+				secretScan = options
+				return nil
+			}
+			externalized := ExternalizeSecrets{}
+			externalizeSecrets = func(directory, target string, options ExternalizeSecrets) error {
+				externalized = options
+				return nil
+			}
+			decryptValues = func(tmpDir string, values []string) ([]string, error) {
+				var result []string
+				for i, value := range values {
+					if isMarkedEncrypted(value) {
+						value = filepath.Join(tmpDir, decryptedValuesDir, fmt.Sprintf("%d-%s", i, filepath.Base(value)))
+					}
+					result = append(result, value)
+				}
+				return result, nil
+			}
+			repository := Repository{}
+			fetch = func(ctx context.Context, tmpDir, repo, chart, version string, config Repository, provenance bool) (string, error) {
+				repository = config
+				return "chart-1.0.0.tgz", nil
+			}
+			var chartFiles []string
+			extractChartFiles = func(chartPackage, rendered string, names []string) error {
+				chartFiles = names
+				return nil
+			}
+			verification := Verification{}
+			verifyChart = func(ctx context.Context, tmpDir, chartFile string, chart *HelmChart, config Repository, options Verification) (*verificationResult, error) {
+				if options.Mode != verifyOff {
+					verification = options
+				}
+				return nil, nil
+			}
+			namespaceGenerated := false
+			generateNamespace = func(directory, namespace string, labels, annotations map[string]string) error {
+				namespaceGenerated = true
+				return nil
+			}
 
-			if err := HelmTemplate(tt.args.filename, tt.args.username, tt.args.password); (err != nil) != tt.wantErr {
+			if err := HelmTemplate(context.Background(), tt.args.filename, tt.args.username, tt.args.password); (err != nil) != tt.wantErr {
 				t.Errorf("HelmTemplate() error = %v, wantErr %v", err, tt.wantErr)
 			} else {
 				assert.EqualValues(t, tt.expectedCommands, executor.commands)
 				assert.Equal(t, tt.wantGenerateKustomization, kustomizationGenerated)
+				assert.Equal(t, tt.wantGenerateNamespace, namespaceGenerated)
+				assert.Equal(t, tt.wantSeparateCRDs, crdsSeparated)
+				assert.Equal(t, tt.wantUmbrella, umbrella)
+				assert.Equal(t, tt.wantImageInventory, imageInventoryWritten)
+				assert.Equal(t, tt.wantImageRewrites, imageRewrites)
+				assert.Equal(t, tt.wantImageLockFile, imageLockFile)
+				assert.Equal(t, tt.wantValidation, validation)
+				assert.Equal(t, tt.wantDeprecationsChecked, deprecationsChecked)
+				assert.Equal(t, tt.wantPolicies, policies)
+				assert.Equal(t, tt.wantSecretScan, secretScan)
+				assert.Equal(t, tt.wantExternalizeSecrets, externalized)
+				assert.Equal(t, tt.wantRepository, repository)
+				assert.Equal(t, tt.wantChartFiles, chartFiles)
+				assert.Equal(t, tt.wantVerification, verification)
+			}
+		})
+	}
+}
+
+func TestHelmTemplateKeepsCustomizations(t *testing.T) {
+	// the in-memory filesystem does not move the content of renamed directories
+	dir := t.TempDir()
+	fs = afero.NewBasePathFs(afero.NewOsFs(), dir)
+	spec := filepath.Join(dir, "helm-chart.yaml")
+	require.NoError(t, ioutil.WriteFile(spec, []byte(`chart: jenkins
+version: 2.0.0
+repository: https://kubernetes-charts.storage.googleapis.com
+name: jenkins
+outputDir: manifests
+postProcess:
+  generateKustomization: true
+`), os.ModePerm))
+	TempDir = func(fs afero.Fs, dir, prefix string) (name string, err error) {
+		return "/temp/helmt-123", fs.MkdirAll("/temp/helmt-123", os.ModePerm)
+	}
+	fetch = func(ctx context.Context, tmpDir, repository, chart, version string, config Repository, provenance bool) (string, error) {
+		return "chart-1.0.0.tgz", afero.WriteFile(fs, "/temp/helmt-123/chart-1.0.0.tgz", newTestChartPackage(t, "jenkins", map[string]string{
+			"Chart.yaml": "apiVersion: v2\nname: jenkins",
+		}), os.ModePerm)
+	}
+	execute = func(name string, opts execOpts, arg ...string) error {
+		if arg[0] != "template" {
+			return nil
+		}
+		return writeFile("/temp/helmt-123/jenkins/templates/deployment.yaml", []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: jenkins
+`), os.ModePerm)
+	}
+	generateKustomization = generateKustomizationCommand
+
+	require.NoError(t, HelmTemplate(context.Background(), spec, "", ""))
+	customized := `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+patches:
+  - path: patches/replicas.yaml
+transformers:
+  - labels.yaml
+# helmt:begin - managed by helmt, changes within this block are overwritten
+resources:
+  - templates/deployment.yaml
+# helmt:end
+`
+	require.NoError(t, afero.WriteFile(fs, "manifests/jenkins/kustomization.yaml", []byte(customized), os.ModePerm))
+	require.NoError(t, writeFile("manifests/jenkins/patches/replicas.yaml", []byte("replicas"), os.ModePerm))
+	require.NoError(t, afero.WriteFile(fs, "manifests/jenkins/labels.yaml", []byte("labels"), os.ModePerm))
+	require.NoError(t, afero.WriteFile(fs, "manifests/jenkins/unreferenced.yaml", []byte("stale"), os.ModePerm))
+
+	require.NoError(t, HelmTemplate(context.Background(), spec, "", ""))
+
+	assert.Equal(t, strings.TrimSuffix(customized, "\n"), ReadFileAsString(t, "manifests/jenkins/kustomization.yaml"))
+	assert.Equal(t, "replicas", ReadFileAsString(t, "manifests/jenkins/patches/replicas.yaml"))
+	assert.Equal(t, "labels", ReadFileAsString(t, "manifests/jenkins/labels.yaml"))
+	exists, err := afero.Exists(fs, "manifests/jenkins/unreferenced.yaml")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func Test_execCommandRedactsSecrets(t *testing.T) {
+	previousRedactions, previousOutput, previousError := redactions, Output, Error
+	defer func() { redactions, Output, Error = previousRedactions, previousOutput, previousError }()
+	redactions = &redactor{}
+	redactions.add("hunter22")
+	output, errorOutput := &bytes.Buffer{}, &bytes.Buffer{}
+	Output, Error = output, errorOutput
+
+	err := execCommand("sh", execOpts{Stdin: strings.NewReader("hunter22")}, "-c", "cat; echo ' rejected' hunter22 >&2")
+	assert.NoError(t, err)
+	assert.Equal(t, "*****", output.String())
+	assert.Equal(t, " rejected *****\n", errorOutput.String())
+}
+
+func TestHelmTemplateStopsHelm(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout string
+		cancel  bool
+		wantErr string
+	}{
+		{name: "canceled", cancel: true, wantErr: "helm template failed: context canceled"},
+		{name: "timeout", timeout: "10ms", wantErr: "helm template timed out after 10ms: helm template failed: context deadline exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set(TemplateTimeoutFlag, tt.timeout)
+			defer viper.Reset()
+			fs = afero.NewMemMapFs()
+			TempDir = func(fs afero.Fs, dir, prefix string) (name string, err error) {
+				return "/temp/helmt-123", fs.MkdirAll("/temp/helmt-123", os.ModePerm)
+			}
+			fetch = func(ctx context.Context, tmpDir, repository, chart, version string, config Repository, provenance bool) (string, error) {
+				return "chart-1.0.0.tgz", afero.WriteFile(fs, "/temp/helmt-123/chart-1.0.0.tgz", nil, os.ModePerm)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			execute = func(name string, opts execOpts, arg ...string) error {
+				if arg[0] != "template" {
+					return nil
+				}
+				if tt.cancel {
+					// like SIGINT while helm is running
+					cancel()
+				}
+				<-opts.Context.Done()
+				return opts.Context.Err()
 			}
+
+			err := HelmTemplate(ctx, "testdata/helm-chart-mandatory-parameters.yaml", "", "")
+			assert.EqualError(t, err, tt.wantErr)
+			exists, err := afero.DirExists(fs, "/temp/helmt-123")
+			assert.NoError(t, err)
+			assert.False(t, exists)
 		})
 	}
 }
 
-func Test_generateKustomization(t *testing.T) {
+func Test_generateNamespace(t *testing.T) {
 	type args struct {
-		directory string
+		namespace   string
+		labels      map[string]string
+		annotations map[string]string
 	}
 	tests := []struct {
 		name            string
 		args            args
 		expectedContent string
-		wantErr         bool
 	}{
 		{
-			name: "jenkins",
+			name: "namespace only",
 			args: args{
-				directory: "testdata/jenkins",
+				namespace: "jenkins",
 			},
-			expectedContent: `apiVersion: kustomize.config.k8s.io/v1beta1
-kind: Kustomization
-resources:
-  - templates/config.yaml
-  - templates/home-pvc.yaml
-  - templates/jcasc-config.yaml
-  - templates/jenkins-agent-svc.yaml
-  - templates/jenkins-master-deployment.yaml
-  - templates/jenkins-master-svc.yaml
-  - templates/rbac.yaml
-  - templates/secret.yaml
-  - templates/service-account.yaml
-  - templates/tests/test-config.yaml`,
-			wantErr: false,
+			expectedContent: `---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: jenkins`,
 		},
 		{
-			name: "prometheus-operator",
+			name: "namespace with labels and annotations",
 			args: args{
-				directory: "testdata/prometheus-operator",
+				namespace:   "infra-monitoring",
+				labels:      map[string]string{"team": "platform", "istio-injection": "enabled"},
+				annotations: map[string]string{"owner": "platform@syncier.com"},
 			},
-			expectedContent: `apiVersion: kustomize.config.k8s.io/v1beta1
-kind: Kustomization
-resources:
-  - charts/grafana/templates/clusterrole.yaml
-  - charts/grafana/templates/clusterrolebinding.yaml
-  - charts/grafana/templates/configmap-dashboard-provider.yaml
-  - charts/grafana/templates/configmap.yaml
-  - charts/grafana/templates/deployment.yaml
-  - charts/grafana/templates/ingress.yaml
-  - charts/grafana/templates/podsecuritypolicy.yaml
-  - charts/grafana/templates/role.yaml
-  - charts/grafana/templates/rolebinding.yaml
-  - charts/grafana/templates/service.yaml
-  - charts/grafana/templates/serviceaccount.yaml
-  - charts/grafana/templates/tests/test-configmap.yaml
-  - charts/grafana/templates/tests/test-podsecuritypolicy.yaml
-  - charts/grafana/templates/tests/test-role.yaml
-  - charts/grafana/templates/tests/test-rolebinding.yaml
-  - charts/grafana/templates/tests/test-serviceaccount.yaml
-  - charts/kube-state-metrics/templates/clusterrole.yaml
-  - charts/kube-state-metrics/templates/clusterrolebinding.yaml
-  - charts/kube-state-metrics/templates/deployment.yaml
-  - charts/kube-state-metrics/templates/podsecuritypolicy.yaml
-  - charts/kube-state-metrics/templates/service.yaml
-  - charts/kube-state-metrics/templates/serviceaccount.yaml
-  - charts/prometheus-node-exporter/templates/daemonset.yaml
-  - charts/prometheus-node-exporter/templates/psp-clusterrole.yaml
-  - charts/prometheus-node-exporter/templates/psp-clusterrolebinding.yaml
-  - charts/prometheus-node-exporter/templates/psp.yaml
-  - charts/prometheus-node-exporter/templates/service.yaml
-  - charts/prometheus-node-exporter/templates/serviceaccount.yaml
-  - crds/crd-alertmanager.yaml
-  - crds/crd-podmonitor.yaml
-  - crds/crd-prometheus.yaml
-  - crds/crd-prometheusrules.yaml
-  - crds/crd-servicemonitor.yaml
-  - crds/crd-thanosrulers.yaml
-  - templates/alertmanager/alertmanager.yaml
-  - templates/alertmanager/ingress.yaml
-  - templates/alertmanager/psp-role.yaml
-  - templates/alertmanager/psp-rolebinding.yaml
-  - templates/alertmanager/psp.yaml
-  - templates/alertmanager/secret.yaml
-  - templates/alertmanager/service.yaml
-  - templates/alertmanager/serviceaccount.yaml
-  - templates/alertmanager/servicemonitor.yaml
-  - templates/exporters/core-dns/service.yaml
-  - templates/exporters/core-dns/servicemonitor.yaml
-  - templates/exporters/kube-api-server/servicemonitor.yaml
-  - templates/exporters/kube-controller-manager/service.yaml
-  - templates/exporters/kube-controller-manager/servicemonitor.yaml
-  - templates/exporters/kube-etcd/service.yaml
-  - templates/exporters/kube-etcd/servicemonitor.yaml
-  - templates/exporters/kube-proxy/service.yaml
-  - templates/exporters/kube-proxy/servicemonitor.yaml
-  - templates/exporters/kube-scheduler/service.yaml
-  - templates/exporters/kube-scheduler/servicemonitor.yaml
-  - templates/exporters/kube-state-metrics/serviceMonitor.yaml
-  - templates/exporters/kubelet/servicemonitor.yaml
-  - templates/exporters/node-exporter/servicemonitor.yaml
-  - templates/grafana/configmaps-datasources.yaml
-  - templates/grafana/dashboards-1.14/apiserver.yaml
-  - templates/grafana/dashboards-1.14/cluster-total.yaml
-  - templates/grafana/dashboards-1.14/controller-manager.yaml
-  - templates/grafana/dashboards-1.14/etcd.yaml
-  - templates/grafana/dashboards-1.14/k8s-coredns.yaml
-  - templates/grafana/dashboards-1.14/k8s-resources-cluster.yaml
-  - templates/grafana/dashboards-1.14/k8s-resources-namespace.yaml
-  - templates/grafana/dashboards-1.14/k8s-resources-node.yaml
-  - templates/grafana/dashboards-1.14/k8s-resources-pod.yaml
-  - templates/grafana/dashboards-1.14/k8s-resources-workload.yaml
-  - templates/grafana/dashboards-1.14/k8s-resources-workloads-namespace.yaml
-  - templates/grafana/dashboards-1.14/kubelet.yaml
-  - templates/grafana/dashboards-1.14/namespace-by-pod.yaml
-  - templates/grafana/dashboards-1.14/namespace-by-workload.yaml
-  - templates/grafana/dashboards-1.14/node-cluster-rsrc-use.yaml
-  - templates/grafana/dashboards-1.14/node-rsrc-use.yaml
-  - templates/grafana/dashboards-1.14/nodes.yaml
-  - templates/grafana/dashboards-1.14/persistentvolumesusage.yaml
-  - templates/grafana/dashboards-1.14/pod-total.yaml
-  - templates/grafana/dashboards-1.14/pods.yaml
-  - templates/grafana/dashboards-1.14/prometheus.yaml
-  - templates/grafana/dashboards-1.14/proxy.yaml
-  - templates/grafana/dashboards-1.14/scheduler.yaml
-  - templates/grafana/dashboards-1.14/statefulset.yaml
-  - templates/grafana/dashboards-1.14/workload-total.yaml
-  - templates/grafana/servicemonitor.yaml
-  - templates/prometheus/additionalPrometheusRules.yaml
-  - templates/prometheus/clusterrole.yaml
-  - templates/prometheus/clusterrolebinding.yaml
-  - templates/prometheus/ingress.yaml
-  - templates/prometheus/prometheus.yaml
-  - templates/prometheus/psp-clusterrole.yaml
-  - templates/prometheus/psp-clusterrolebinding.yaml
-  - templates/prometheus/psp.yaml
-  - templates/prometheus/rules-1.14/alertmanager.rules.yaml
-  - templates/prometheus/rules-1.14/etcd.yaml
-  - templates/prometheus/rules-1.14/general.rules.yaml
-  - templates/prometheus/rules-1.14/k8s.rules.yaml
-  - templates/prometheus/rules-1.14/kube-apiserver-error-alerts.yaml
-  - templates/prometheus/rules-1.14/kube-apiserver-error.yaml
-  - templates/prometheus/rules-1.14/kube-apiserver-slos.yaml
-  - templates/prometheus/rules-1.14/kube-apiserver.rules.yaml
-  - templates/prometheus/rules-1.14/kube-prometheus-general.rules.yaml
-  - templates/prometheus/rules-1.14/kube-prometheus-node-recording.rules.yaml
-  - templates/prometheus/rules-1.14/kube-scheduler.rules.yaml
-  - templates/prometheus/rules-1.14/kube-state-metrics.yaml
-  - templates/prometheus/rules-1.14/kubelet.rules.yaml
-  - templates/prometheus/rules-1.14/kubernetes-absent.yaml
-  - templates/prometheus/rules-1.14/kubernetes-apps.yaml
-  - templates/prometheus/rules-1.14/kubernetes-resources.yaml
-  - templates/prometheus/rules-1.14/kubernetes-storage.yaml
-  - templates/prometheus/rules-1.14/kubernetes-system-apiserver.yaml
-  - templates/prometheus/rules-1.14/kubernetes-system-controller-manager.yaml
-  - templates/prometheus/rules-1.14/kubernetes-system-kubelet.yaml
-  - templates/prometheus/rules-1.14/kubernetes-system-scheduler.yaml
-  - templates/prometheus/rules-1.14/kubernetes-system.yaml
-  - templates/prometheus/rules-1.14/node-exporter.rules.yaml
-  - templates/prometheus/rules-1.14/node-exporter.yaml
-  - templates/prometheus/rules-1.14/node-network.yaml
-  - templates/prometheus/rules-1.14/node-time.yaml
-  - templates/prometheus/rules-1.14/node.rules.yaml
-  - templates/prometheus/rules-1.14/prometheus-operator.yaml
-  - templates/prometheus/rules-1.14/prometheus.yaml
-  - templates/prometheus/service.yaml
-  - templates/prometheus/serviceaccount.yaml
-  - templates/prometheus/servicemonitor.yaml
-  - templates/prometheus-operator/admission-webhooks/mutatingWebhookConfiguration.yaml
-  - templates/prometheus-operator/admission-webhooks/validatingWebhookConfiguration.yaml
-  - templates/prometheus-operator/clusterrole.yaml
-  - templates/prometheus-operator/clusterrolebinding.yaml
-  - templates/prometheus-operator/deployment.yaml
-  - templates/prometheus-operator/psp-clusterrole.yaml
-  - templates/prometheus-operator/psp-clusterrolebinding.yaml
-  - templates/prometheus-operator/psp.yaml
-  - templates/prometheus-operator/service.yaml
-  - templates/prometheus-operator/serviceaccount.yaml
-  - templates/prometheus-operator/servicemonitor.yaml`,
-			wantErr: false,
+			expectedContent: `---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: infra-monitoring
+  labels:
+    istio-injection: enabled
+    team: platform
+  annotations:
+    owner: platform@syncier.com`,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			fs = afero.NewOsFs()
-			dir, err := ioutil.TempDir("", "kustomization")
-			assert.NoError(t, err)
-			err = copy.Copy(tt.args.directory, dir)
-			assert.NoError(t, err)
+			fs = afero.NewMemMapFs()
 
-			if err := generateKustomizationCommand(dir); (err != nil) != tt.wantErr {
-				t.Errorf("generateKustomizationCommand() error = %v, wantErr %v", err, tt.wantErr)
-			}
-			kustomization := path.Join(dir, "kustomization.yaml")
-			stat, err := fs.Stat(kustomization)
+			err := generateNamespaceCommand("/temp/helmt-123/jenkins", tt.args.namespace, tt.args.labels, tt.args.annotations)
 			require.NoError(t, err)
 
-			assert.False(t, stat.IsDir())
-			assert.Equal(t, tt.expectedContent, ReadFileAsString(t, kustomization))
+			assert.Equal(t, tt.expectedContent, ReadFileAsString(t, "/temp/helmt-123/jenkins/namespace.yaml"))
 		})
 	}
 }
@@ -532,3 +941,90 @@ func ReadFileAsString(t *testing.T, filename string) string {
 	}
 	return strings.TrimSuffix(string(expectedContent), "\n")
 }
+
+func TestRemoveTemporaryDirectories(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	require.NoError(t, fs.MkdirAll("helmt-123/.decrypted-values", 0700))
+	temporaryDirectories.Lock()
+	temporaryDirectories.paths["helmt-123"] = true
+	temporaryDirectories.Unlock()
+
+	RemoveTemporaryDirectories()
+
+	exists, err := afero.DirExists(fs, "helmt-123")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Empty(t, temporaryDirectories.paths)
+}
+
+func Test_moveSeparatedCRDs(t *testing.T) {
+	fs = afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+	generateKustomization = generateKustomizationCommand
+	require.NoError(t, writeFile("/temp/helmt-123/crds/crd.yaml", []byte("apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata:\n  name: jobs.jenkins.io\n"), os.ModePerm))
+	chart := &HelmChart{Chart: "jenkins", Version: "2.0.0", Name: "jenkins", PostProcess: PostProcess{
+		GenerateKustomization: true,
+		Kustomization: Kustomization{
+			NamePrefix: "prod-",
+			Images:     []KustomizeImage{{Name: "jenkins", NewTag: "2.0"}},
+			Patches:    []yaml.MapSlice{{{Key: "path", Value: "patch.yaml"}}},
+		},
+	}}
+
+	require.NoError(t, moveSeparatedCRDs("/temp/helmt-123/crds", "/manifests/jenkins-crds", chart, nil))
+
+	assert.Equal(t, `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# helmt:begin - managed by helmt, changes within this block are overwritten
+resources:
+  - crd.yaml
+# helmt:end`, ReadFileAsString(t, "/manifests/jenkins-crds/kustomization.yaml"))
+}
+
+func TestHelmTemplateExtractsChartFilesAfterKustomization(t *testing.T) {
+	dir := t.TempDir()
+	fs = afero.NewBasePathFs(afero.NewOsFs(), dir)
+	spec := filepath.Join(dir, "helm-chart.yaml")
+	require.NoError(t, ioutil.WriteFile(spec, []byte(`chart: jenkins
+version: 2.0.0
+repository: https://kubernetes-charts.storage.googleapis.com
+name: jenkins
+outputDir: manifests
+postProcess:
+  generateKustomization: true
+  chartFiles:
+    - values.yaml
+`), os.ModePerm))
+	// a values file like this is no valid manifest header
+	values := "kind: 1\nmetadata:\n  - name: jenkins\n"
+	TempDir = func(fs afero.Fs, dir, prefix string) (name string, err error) {
+		return "/temp/helmt-123", fs.MkdirAll("/temp/helmt-123", os.ModePerm)
+	}
+	fetch = func(ctx context.Context, tmpDir, repository, chart, version string, config Repository, provenance bool) (string, error) {
+		return "chart-1.0.0.tgz", afero.WriteFile(fs, "/temp/helmt-123/chart-1.0.0.tgz", newTestChartPackage(t, "jenkins", map[string]string{
+			"Chart.yaml":  "apiVersion: v2\nname: jenkins",
+			"values.yaml": values,
+		}), os.ModePerm)
+	}
+	execute = func(name string, opts execOpts, arg ...string) error {
+		if arg[0] != "template" {
+			return nil
+		}
+		return writeFile("/temp/helmt-123/jenkins/templates/deployment.yaml", []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: jenkins
+`), os.ModePerm)
+	}
+	generateKustomization = generateKustomizationCommand
+	extractChartFiles = extractChartFilesCommand
+
+	require.NoError(t, HelmTemplate(context.Background(), spec, "", ""))
+
+	assert.Equal(t, strings.TrimSuffix(values, "\n"), ReadFileAsString(t, "manifests/jenkins/values.yaml"))
+	assert.Equal(t, `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# helmt:begin - managed by helmt, changes within this block are overwritten
+resources:
+  - templates/deployment.yaml
+# helmt:end`, ReadFileAsString(t, "manifests/jenkins/kustomization.yaml"))
+}
@@ -0,0 +1,320 @@
+package helmt
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	imagesFile     = "images.txt"
+	imagesJSONFile = "images.json"
+)
+
+var containerTypes = []string{"initContainers", "containers", "ephemeralContainers"}
+
+type ImageRewriteRule struct {
+	From string `yaml:"from" validate:"required"`
+	To   string `yaml:"to" validate:"required"`
+}
+
+type ImageInventory struct {
+	Images []InventoryImage `json:"images"`
+}
+
+type InventoryImage struct {
+	Image  string       `json:"image"`
+	Usages []ImageUsage `json:"usages"`
+}
+
+type ImageUsage struct {
+	File          string `json:"file"`
+	Kind          string `json:"kind"`
+	Name          string `json:"name"`
+	Namespace     string `json:"namespace,omitempty"`
+	ContainerType string `json:"containerType"`
+	Container     string `json:"container"`
+}
+
+// podSpecPath returns where the pod spec is located within a workload or nil if kind is no workload.
+func podSpecPath(kind string) []string {
+	switch kind {
+	case "Pod":
+		return []string{"spec"}
+	case "PodTemplate":
+		return []string{"template", "spec"}
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job":
+		return []string{"spec", "template", "spec"}
+	case "CronJob":
+		return []string{"spec", "jobTemplate", "spec", "template", "spec"}
+	}
+	return nil
+}
+
+// containerVisitor is called for every container of a workload. Changes of the container are written back.
+type containerVisitor func(manifest map[interface{}]interface{}, containerType string, container map[interface{}]interface{}) error
+
+// visitContainers calls visit for all containers of the workload, init and ephemeral containers included.
+func visitContainers(manifest map[interface{}]interface{}, visit containerVisitor) error {
+	kind, _ := manifest["kind"].(string)
+	path := podSpecPath(kind)
+	if path == nil {
+		return nil
+	}
+	podSpec, ok := lookup(manifest, path...).(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	for _, containerType := range containerTypes {
+		containers, _ := podSpec[containerType].([]interface{})
+		for _, c := range containers {
+			container, ok := c.(map[interface{}]interface{})
+			if !ok {
+				continue
+			}
+			err := visit(manifest, containerType, container)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// collectImages returns all container images of the workloads rendered into directory.
+func collectImages(directory string) (*ImageInventory, error) {
+	usages := map[string][]ImageUsage{}
+	err := walkManifests(directory, func(path string, documents [][]byte) error {
+		rel, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		for _, document := range documents {
+			manifest, err := parseManifest(document)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", path, err)
+			}
+			err = visitContainers(manifest, func(manifest map[interface{}]interface{}, containerType string, container map[interface{}]interface{}) error {
+				image, _ := container["image"].(string)
+				if image == "" {
+					return nil
+				}
+				name, _ := lookup(manifest, "metadata", "name").(string)
+				namespace, _ := lookup(manifest, "metadata", "namespace").(string)
+				containerName, _ := container["name"].(string)
+				usages[image] = append(usages[image], ImageUsage{
+					File:          filepath.ToSlash(rel),
+					Kind:          manifest["kind"].(string),
+					Name:          name,
+					Namespace:     namespace,
+					ContainerType: strings.TrimSuffix(containerType, "s"),
+					Container:     containerName,
+				})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	inventory := &ImageInventory{Images: []InventoryImage{}}
+	for image, u := range usages {
+		inventory.Images = append(inventory.Images, InventoryImage{Image: image, Usages: u})
+	}
+	sort.Slice(inventory.Images, func(i, j int) bool { return inventory.Images[i].Image < inventory.Images[j].Image })
+	return inventory, nil
+}
+
+// writeImageInventoryCommand writes images.txt, one image per line, and images.json containing the usages of every image.
+func writeImageInventoryCommand(directory string) error {
+	inventory, err := collectImages(directory)
+	if err != nil {
+		return err
+	}
+
+	text := &strings.Builder{}
+	for _, image := range inventory.Images {
+		text.WriteString(image.Image + "\n")
+	}
+	err = afero.WriteFile(fs, filepath.Join(directory, imagesFile), []byte(text.String()), 0644)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(inventory, "", "  ")
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, filepath.Join(directory, imagesJSONFile), append(content, '\n'), 0644)
+}
+
+// PrintImages prints the image inventory of the chart described by filename, which has been written by the last run.
+func PrintImages(filename string, asJSON bool) error {
+	chart, err := readParameters(filename)
+	if err != nil {
+		return err
+	}
+	report := imagesFile
+	if asJSON {
+		report = imagesJSONFile
+	}
+	content, err := afero.ReadFile(fs, filepath.Join(outputTarget(chart), report))
+	if err != nil {
+		return fmt.Errorf("failed to read image inventory, please render the chart with postProcess.imageInventory enabled: %v", err)
+	}
+	_, err = Output.Write(content)
+	return err
+}
+
+// replaceImagesInDirectory replaces every container image in the manifests below directory by the result of replace.
+// Only the image fields are touched, the formatting and comments of the manifests are kept. Documents whose image
+// fields can not be replaced line by line, e.g. flow style yaml, are written from the parsed manifest instead.
+func replaceImagesInDirectory(directory string, replace func(image string) (string, error)) error {
+	return walkManifests(directory, func(path string, documents [][]byte) error {
+		changed := false
+		for i, document := range documents {
+			manifest, err := parseManifest(document)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", path, err)
+			}
+			replacements := map[string]string{}
+			counts := map[string]int{}
+			err = visitContainers(manifest, func(manifest map[interface{}]interface{}, containerType string, container map[interface{}]interface{}) error {
+				image, _ := container["image"].(string)
+				if image == "" {
+					return nil
+				}
+				replacement, err := replace(image)
+				if err != nil {
+					return err
+				}
+				if replacement != image {
+					replacements[image] = replacement
+					counts[image]++
+					container["image"] = replacement
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(replacements) == 0 {
+				continue
+			}
+			replaced, ok := replaceImages(document, replacements, counts)
+			if !ok {
+				replaced, err = yaml.Marshal(manifest)
+				if err != nil {
+					return err
+				}
+				replaced = append(leadingComments(document), replaced...)
+			}
+			documents[i] = replaced
+			changed = true
+		}
+		if !changed {
+			return nil
+		}
+		return afero.WriteFile(fs, path, joinDocuments(documents), 0644)
+	})
+}
+
+// replaceImages replaces the values of all image fields of the document according to replacements. counts contains
+// how many containers use an image, false is returned if the image fields are not found exactly that often as block
+// style lines, e.g. for flow style yaml or if an image line is part of a block scalar.
+func replaceImages(document []byte, replacements map[string]string, counts map[string]int) ([]byte, bool) {
+	for image, replacement := range replacements {
+		field := regexp.MustCompile(`(?m)^([ \t]*(?:- )?image:[ \t]*)(["']?)` + regexp.QuoteMeta(image) + `(["']?)[ \t]*$`)
+		if len(field.FindAllIndex(document, -1)) != counts[image] {
+			return nil, false
+		}
+		document = field.ReplaceAll(document, []byte("${1}${2}"+strings.ReplaceAll(replacement, "$", "$$")+"${3}"))
+	}
+	return document, true
+}
+
+// normalizeImage adds the implicit docker hub registry and library namespace, like docker does.
+func normalizeImage(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return image
+	}
+	if len(parts) == 1 {
+		return "docker.io/library/" + image
+	}
+	return "docker.io/" + image
+}
+
+// rewriteImagesCommand rewrites all container images according to the longest matching rule.
+// Images which match no rule are reported.
+func rewriteImagesCommand(directory string, rules []ImageRewriteRule) error {
+	unmatched := map[string]bool{}
+	err := replaceImagesInDirectory(directory, func(image string) (string, error) {
+		rewritten, ok := rewriteImage(image, rules)
+		if !ok {
+			unmatched[image] = true
+		}
+		return rewritten, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	images := []string{}
+	for image := range unmatched {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	for _, image := range images {
+		color.Yellow("Warning: image %s does not match any rewrite rule", image)
+	}
+	return nil
+}
+
+func rewriteImage(image string, rules []ImageRewriteRule) (string, bool) {
+	normalized := normalizeImage(image)
+	var match *ImageRewriteRule
+	for i, rule := range rules {
+		if hasImagePrefix(image, rule.To) || hasImagePrefix(normalized, rule.To) {
+			// already pointing to a mirror
+			return image, true
+		}
+		if !hasImagePrefix(image, rule.From) && !hasImagePrefix(normalized, rule.From) {
+			continue
+		}
+		if match == nil || len(rule.From) > len(match.From) {
+			match = &rules[i]
+		}
+	}
+	if match == nil {
+		return image, false
+	}
+	if hasImagePrefix(image, match.From) {
+		return match.To + strings.TrimPrefix(image, match.From), true
+	}
+	return match.To + strings.TrimPrefix(normalized, match.From), true
+}
+
+// hasImagePrefix checks whether image starts with prefix, which has to end at a separator of the image reference,
+// so docker.io/library/nginx does not match docker.io/library/nginx-ingress.
+func hasImagePrefix(image, prefix string) bool {
+	if !strings.HasPrefix(image, prefix) {
+		return false
+	}
+	if len(image) == len(prefix) || strings.HasSuffix(prefix, "/") {
+		return true
+	}
+	return strings.ContainsRune("/:@", rune(image[len(prefix)]))
+}
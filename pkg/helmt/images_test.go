@@ -0,0 +1,255 @@
+package helmt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/otiai10/copy"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_collectImages(t *testing.T) {
+	fs = afero.NewOsFs()
+
+	inventory, err := collectImages("testdata/workloads")
+	require.NoError(t, err)
+
+	assert.Equal(t, &ImageInventory{Images: []InventoryImage{
+		{Image: "busybox", Usages: []ImageUsage{
+			{File: "templates/pod.yaml", Kind: "Pod", Name: "debug", ContainerType: "container", Container: "app"},
+		}},
+		{Image: "docker.io/library/busybox:1.33", Usages: []ImageUsage{
+			{File: "templates/pod.yaml", Kind: "Pod", Name: "debug", ContainerType: "ephemeralContainer", Container: "debugger"},
+		}},
+		{Image: "nginx:1.19", Usages: []ImageUsage{
+			{File: "templates/cronjob.yaml", Kind: "CronJob", Name: "cleanup", ContainerType: "container", Container: "cleanup"},
+			{File: "templates/deployment.yaml", Kind: "Deployment", Name: "web", Namespace: "shop", ContainerType: "container", Container: "web"},
+		}},
+		{Image: "quay.io/prometheus/nginx-exporter:0.8.0", Usages: []ImageUsage{
+			{File: "templates/deployment.yaml", Kind: "Deployment", Name: "web", Namespace: "shop", ContainerType: "container", Container: "metrics"},
+		}},
+		{Image: "registry.example.com/shop/migrate:1.0.0", Usages: []ImageUsage{
+			{File: "templates/deployment.yaml", Kind: "Deployment", Name: "web", Namespace: "shop", ContainerType: "initContainer", Container: "migrate"},
+		}},
+	}}, inventory)
+}
+
+func Test_writeImageInventory(t *testing.T) {
+	fs = afero.NewOsFs()
+	dir, err := ioutil.TempDir("", "images")
+	require.NoError(t, err)
+	defer func() { _ = fs.RemoveAll(dir) }()
+	require.NoError(t, copy.Copy("testdata/workloads", dir))
+
+	err = writeImageInventoryCommand(dir)
+	require.NoError(t, err)
+
+	assert.Equal(t, `busybox
+docker.io/library/busybox:1.33
+nginx:1.19
+quay.io/prometheus/nginx-exporter:0.8.0
+registry.example.com/shop/migrate:1.0.0`, ReadFileAsString(t, filepath.Join(dir, "images.txt")))
+	assert.Contains(t, ReadFileAsString(t, filepath.Join(dir, "images.json")), `{
+      "image": "registry.example.com/shop/migrate:1.0.0",
+      "usages": [
+        {
+          "file": "templates/deployment.yaml",
+          "kind": "Deployment",
+          "name": "web",
+          "namespace": "shop",
+          "containerType": "initContainer",
+          "container": "migrate"
+        }
+      ]
+    }`)
+}
+
+func TestPrintImages(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "manifests/syncier-jenkins/images.txt", []byte("jenkins/jenkins:2.263.1\n"), os.ModePerm))
+	output := &bytes.Buffer{}
+	previous := Output
+	Output = output
+	defer func() { Output = previous }()
+
+	err := PrintImages("testdata/helm-chart-output-dir.yaml", false)
+	require.NoError(t, err)
+	assert.Equal(t, "jenkins/jenkins:2.263.1\n", output.String())
+
+	err = PrintImages("testdata/helm-chart-output-dir.yaml", true)
+	assert.Error(t, err)
+}
+
+func Test_rewriteImage(t *testing.T) {
+	rules := []ImageRewriteRule{
+		{From: "docker.io/", To: "mirror.local/dockerhub/"},
+		{From: "docker.io/bitnami/", To: "mirror.local/bitnami/"},
+		{From: "quay.io/", To: "mirror.local/quay/"},
+		{From: "quay.io/prometheus/node", To: "mirror.local/node"},
+	}
+	tests := []struct {
+		image       string
+		expected    string
+		wantMatched bool
+	}{
+		{image: "nginx", expected: "mirror.local/dockerhub/library/nginx", wantMatched: true},
+		{image: "nginx:1.19", expected: "mirror.local/dockerhub/library/nginx:1.19", wantMatched: true},
+		{image: "jenkins/jenkins:lts", expected: "mirror.local/dockerhub/jenkins/jenkins:lts", wantMatched: true},
+		{image: "docker.io/library/busybox:1.33", expected: "mirror.local/dockerhub/library/busybox:1.33", wantMatched: true},
+		{image: "bitnami/redis:6.0", expected: "mirror.local/bitnami/redis:6.0", wantMatched: true},
+		{image: "quay.io/prometheus/node-exporter:v1.0.1", expected: "mirror.local/quay/prometheus/node-exporter:v1.0.1", wantMatched: true},
+		{image: "mirror.local/quay/prometheus/node-exporter:v1.0.1", expected: "mirror.local/quay/prometheus/node-exporter:v1.0.1", wantMatched: true},
+		{image: "k8s.gcr.io/pause:3.2", expected: "k8s.gcr.io/pause:3.2", wantMatched: false},
+		{image: "localhost:5000/app:1.0", expected: "localhost:5000/app:1.0", wantMatched: false},
+		{image: "quay.io/prometheus/node:v1.0.1", expected: "mirror.local/node:v1.0.1", wantMatched: true},
+		{image: "quay.io/prometheus/node@sha256:0123", expected: "mirror.local/node@sha256:0123", wantMatched: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			actual, matched := rewriteImage(tt.image, rules)
+			assert.Equal(t, tt.expected, actual)
+			assert.Equal(t, tt.wantMatched, matched)
+		})
+	}
+}
+
+func Test_rewriteImages(t *testing.T) {
+	fs = afero.NewOsFs()
+	dir, err := ioutil.TempDir("", "images")
+	require.NoError(t, err)
+	defer func() { _ = fs.RemoveAll(dir) }()
+	require.NoError(t, copy.Copy("testdata/workloads", dir))
+
+	err = rewriteImagesCommand(dir, []ImageRewriteRule{
+		{From: "docker.io/", To: "mirror.local/dockerhub/"},
+		{From: "quay.io/", To: "mirror.local/quay/"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, `---
+# Source: workloads/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: shop
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: migrate
+          image: registry.example.com/shop/migrate:1.0.0
+      containers:
+        - name: web
+          image: mirror.local/dockerhub/library/nginx:1.19
+        - name: metrics
+          image: mirror.local/quay/prometheus/nginx-exporter:0.8.0
+---
+# Source: workloads/templates/deployment.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+    - port: 80`, ReadFileAsString(t, filepath.Join(dir, "templates/deployment.yaml")))
+	assert.Contains(t, ReadFileAsString(t, filepath.Join(dir, "templates/cronjob.yaml")), "image: mirror.local/dockerhub/library/nginx:1.19")
+	assert.Contains(t, ReadFileAsString(t, filepath.Join(dir, "templates/pod.yaml")), "image: mirror.local/dockerhub/library/busybox\n")
+	assert.Contains(t, ReadFileAsString(t, filepath.Join(dir, "templates/pod.yaml")), "image: mirror.local/dockerhub/library/busybox:1.33")
+}
+
+func Test_replaceImages(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		counts   map[string]int
+		expected string
+		wantOk   bool
+	}{
+		{
+			name: "block style",
+			document: `spec:
+  containers:
+    - image: "nginx:1.19"
+    - name: sidecar
+      image: 'nginx:1.19'
+    - name: other
+      image: nginx:1.19-alpine
+`,
+			counts: map[string]int{"nginx:1.19": 2},
+			expected: `spec:
+  containers:
+    - image: "mirror.local/nginx:1.19"
+    - name: sidecar
+      image: 'mirror.local/nginx:1.19'
+    - name: other
+      image: nginx:1.19-alpine
+`,
+			wantOk: true,
+		},
+		{
+			name: "flow style",
+			document: `spec:
+  containers:
+    - {name: web, image: "nginx:1.19"}
+`,
+			counts: map[string]int{"nginx:1.19": 1},
+		},
+		{
+			name: "block scalar",
+			document: `metadata:
+  annotations:
+    example: |
+      image: nginx:1.19
+spec:
+  containers:
+    - image: nginx:1.19
+`,
+			counts: map[string]int{"nginx:1.19": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, ok := replaceImages([]byte(tt.document), map[string]string{"nginx:1.19": "mirror.local/nginx:1.19"}, tt.counts)
+			assert.Equal(t, tt.wantOk, ok)
+			if tt.wantOk {
+				assert.Equal(t, tt.expected, string(actual))
+			}
+		})
+	}
+}
+
+func Test_replaceImagesInDirectoryFlowStyle(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/rendered/templates/pod.yaml", []byte(`---
+# Source: app/templates/pod.yaml
+apiVersion: v1
+kind: Pod
+metadata: {name: app, annotations: {example: "image: nginx:1.19"}}
+spec:
+  containers: [{name: app, image: "nginx:1.19"}]
+`), os.ModePerm))
+
+	err := replaceImagesInDirectory("/rendered", func(image string) (string, error) {
+		return "mirror.local/" + image, nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, `---
+# Source: app/templates/pod.yaml
+apiVersion: v1
+kind: Pod
+metadata:
+  annotations:
+    example: 'image: nginx:1.19'
+  name: app
+spec:
+  containers:
+  - image: mirror.local/nginx:1.19
+    name: app`, ReadFileAsString(t, "/rendered/templates/pod.yaml"))
+}
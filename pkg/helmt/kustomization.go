@@ -0,0 +1,460 @@
+package helmt
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	kustomizationFile = "kustomization.yaml"
+	kustomizationHead = `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+`
+	// fields between these markers are managed by helmt, everything else in an existing kustomization.yaml is kept
+	managedBlockBegin = "# helmt:begin"
+	managedBlockEnd   = "# helmt:end"
+	managedBlockHint  = " - managed by helmt, changes within this block are overwritten"
+)
+
+// Kustomization contains the optional fields written into the generated kustomization.yaml.
+type Kustomization struct {
+	Namespace         string            `yaml:"namespace,omitempty"`
+	NamePrefix        string            `yaml:"namePrefix,omitempty"`
+	CommonLabels      map[string]string `yaml:"commonLabels,omitempty"`
+	CommonAnnotations map[string]string `yaml:"commonAnnotations,omitempty"`
+	Images            []KustomizeImage  `yaml:"images,omitempty"`
+	// Patches are passed through as they are, paths are relative to the rendered chart directory.
+	Patches []yaml.MapSlice `yaml:"patches,omitempty"`
+	// PerDirectory generates a kustomization.yaml for every subdirectory, which is referenced by its parent.
+	PerDirectory bool `yaml:"perDirectory"`
+}
+
+type KustomizeImage struct {
+	Name    string `yaml:"name"`
+	NewName string `yaml:"newName,omitempty"`
+	NewTag  string `yaml:"newTag,omitempty"`
+	Digest  string `yaml:"digest,omitempty"`
+}
+
+type kustomizationHeader struct {
+	Namespace         string            `yaml:"namespace,omitempty"`
+	NamePrefix        string            `yaml:"namePrefix,omitempty"`
+	CommonLabels      map[string]string `yaml:"commonLabels,omitempty"`
+	CommonAnnotations map[string]string `yaml:"commonAnnotations,omitempty"`
+}
+
+type kustomizationTrailer struct {
+	Images  []KustomizeImage `yaml:"images,omitempty"`
+	Patches []yaml.MapSlice  `yaml:"patches,omitempty"`
+}
+
+func generateKustomizationCommand(directory string, options Kustomization) error {
+	resources, err := collectResources(directory, options.PerDirectory)
+	if err != nil {
+		return err
+	}
+	return writeKustomization(directory, resources, &options)
+}
+
+// collectResources returns all kubernetes manifests below directory sorted by path.
+// Files which do not contain any kubernetes resource, like Chart.yaml, are left out.
+// If perDirectory is set, subdirectories get their own kustomization.yaml and are referenced instead.
+func collectResources(directory string, perDirectory bool) ([]string, error) {
+	entries, err := afero.ReadDir(fs, directory)
+	if err != nil {
+		return nil, err
+	}
+	// sorting by name per directory results in the same order as walking the tree
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	resources := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		current := filepath.Join(directory, name)
+		if entry.IsDir() {
+			nested, err := collectResources(current, perDirectory)
+			if err != nil {
+				return nil, err
+			}
+			if len(nested) == 0 {
+				continue
+			}
+			if perDirectory {
+				err = writeKustomization(current, nested, nil)
+				if err != nil {
+					return nil, err
+				}
+				resources = append(resources, name)
+				continue
+			}
+			for _, resource := range nested {
+				resources = append(resources, filepath.ToSlash(filepath.Join(name, resource)))
+			}
+			continue
+		}
+		if name == kustomizationFile {
+			continue
+		}
+		isResource, err := isKubernetesManifest(current)
+		if err != nil {
+			return nil, err
+		}
+		if isResource {
+			resources = append(resources, name)
+		}
+	}
+	return resources, nil
+}
+
+// isKubernetesManifest checks whether the file contains at least one document with apiVersion and kind.
+func isKubernetesManifest(path string) (bool, error) {
+	if !isManifestFile(path) {
+		return false, nil
+	}
+	content, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return false, err
+	}
+	for _, document := range splitDocuments(content) {
+		header, err := parseManifestHeader(document)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		if header.ApiVersion != "" && header.Kind != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func writeKustomization(directory string, resources []string, options *Kustomization) error {
+	content, err := renderKustomization(resources, options)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, filepath.Join(directory, kustomizationFile), content, 0644)
+}
+
+func renderKustomization(resources []string, options *Kustomization) ([]byte, error) {
+	content := &bytes.Buffer{}
+	content.WriteString(kustomizationHead)
+	content.WriteString(managedBlockBegin + managedBlockHint + "\n")
+	if options != nil {
+		err := marshalInto(content, kustomizationHeader{
+			Namespace:         options.Namespace,
+			NamePrefix:        options.NamePrefix,
+			CommonLabels:      options.CommonLabels,
+			CommonAnnotations: options.CommonAnnotations,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	content.WriteString("resources:\n")
+	for _, resource := range resources {
+		content.WriteString(fmt.Sprintf("  - %s\n", resource))
+	}
+	if options != nil {
+		err := marshalInto(content, kustomizationTrailer{
+			Images:  options.Images,
+			Patches: options.Patches,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	content.WriteString(managedBlockEnd + "\n")
+	return content.Bytes(), nil
+}
+
+func marshalInto(buffer *bytes.Buffer, value interface{}) error {
+	content, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if string(content) != "{}\n" {
+		buffer.Write(content)
+	}
+	return nil
+}
+
+// preserveKustomizations keeps the customizations of all kustomization.yaml files in the previous output target
+// by replacing only their managed block with the freshly generated one in rendered.
+func preserveKustomizations(rendered, target string) error {
+	return afero.Walk(fs, rendered, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != kustomizationFile {
+			return nil
+		}
+		rel, err := filepath.Rel(rendered, path)
+		if err != nil {
+			return err
+		}
+		previous := filepath.Join(target, rel)
+		exists, err := afero.Exists(fs, previous)
+		if err != nil || !exists {
+			return err
+		}
+
+		existing, err := afero.ReadFile(fs, previous)
+		if err != nil {
+			return err
+		}
+		generated, err := afero.ReadFile(fs, path)
+		if err != nil {
+			return err
+		}
+		merged, err := mergeKustomization(generated, existing)
+		if err != nil {
+			return fmt.Errorf("failed to preserve %s: %v", previous, err)
+		}
+		err = afero.WriteFile(fs, path, merged, 0644)
+		if err != nil {
+			return err
+		}
+		return preserveReferencedFiles(merged, filepath.Dir(path), filepath.Dir(previous), rendered, target)
+	})
+}
+
+// kustomizationReferences contains the fields of a kustomization which reference local files.
+type kustomizationReferences struct {
+	Resources             []string `yaml:"resources"`
+	Components            []string `yaml:"components"`
+	Crds                  []string `yaml:"crds"`
+	Configurations        []string `yaml:"configurations"`
+	Generators            []string `yaml:"generators"`
+	Transformers          []string `yaml:"transformers"`
+	Validators            []string `yaml:"validators"`
+	PatchesStrategicMerge []string `yaml:"patchesStrategicMerge"`
+	Patches               []struct {
+		Path string `yaml:"path"`
+	} `yaml:"patches"`
+	PatchesJson6902 []struct {
+		Path string `yaml:"path"`
+	} `yaml:"patchesJson6902"`
+	Replacements []struct {
+		Path string `yaml:"path"`
+	} `yaml:"replacements"`
+	ConfigMapGenerator []kustomizationGeneratorReferences `yaml:"configMapGenerator"`
+	SecretGenerator    []kustomizationGeneratorReferences `yaml:"secretGenerator"`
+}
+
+type kustomizationGeneratorReferences struct {
+	Files []string `yaml:"files"`
+	Envs  []string `yaml:"envs"`
+	Env   string   `yaml:"env"`
+}
+
+func (r kustomizationReferences) paths() []string {
+	paths := []string{}
+	for _, list := range [][]string{r.Resources, r.Components, r.Crds, r.Configurations, r.Generators, r.Transformers, r.Validators, r.PatchesStrategicMerge} {
+		paths = append(paths, list...)
+	}
+	for _, patch := range r.Patches {
+		paths = append(paths, patch.Path)
+	}
+	for _, patch := range r.PatchesJson6902 {
+		paths = append(paths, patch.Path)
+	}
+	for _, replacement := range r.Replacements {
+		paths = append(paths, replacement.Path)
+	}
+	for _, generator := range append(r.ConfigMapGenerator, r.SecretGenerator...) {
+		for _, file := range generator.Files {
+			// files may be given as key=path
+			paths = append(paths, file[strings.Index(file, "=")+1:])
+		}
+		paths = append(paths, generator.Envs...)
+		paths = append(paths, generator.Env)
+	}
+	return paths
+}
+
+// preserveReferencedFiles copies the files of the previous output target referenced by the kustomization, e.g.
+// hand-written patches or transformers, into the rendered chart. Files which are rendered again are not copied.
+// kustomize only loads files within the directory of the kustomization, references to files outside of the target
+// are not touched since they are not removed.
+func preserveReferencedFiles(kustomization []byte, renderedDir, previousDir, rendered, target string) error {
+	references := kustomizationReferences{}
+	err := yaml.Unmarshal(kustomization, &references)
+	if err != nil {
+		return err
+	}
+	for _, reference := range references.paths() {
+		// inline patches, remote resources and absolute paths are no local files of the target
+		if reference == "" || strings.Contains(reference, "\n") || strings.Contains(reference, "://") || filepath.IsAbs(reference) {
+			continue
+		}
+		previous := filepath.Join(previousDir, reference)
+		rel, err := filepath.Rel(target, previous)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		exists, err := afero.Exists(fs, filepath.Join(rendered, rel))
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		exists, err = afero.Exists(fs, previous)
+		if err != nil {
+			return err
+		}
+		if exists {
+			err = copyPath(previous, filepath.Join(renderedDir, reference))
+			if err != nil {
+				return fmt.Errorf("failed to preserve %s: %v", previous, err)
+			}
+		}
+	}
+	return nil
+}
+
+// copyPath copies the file or the directory source with all of its content to destination.
+func copyPath(source, destination string) error {
+	return afero.Walk(fs, source, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		content, err := afero.ReadFile(fs, path)
+		if err != nil {
+			return err
+		}
+		return writeFile(filepath.Join(destination, rel), content, info.Mode())
+	})
+}
+
+// mergeKustomization replaces the managed block of existing with the one of generated.
+// An existing kustomization without a managed block is only replaced, if it does not contain any customizations.
+func mergeKustomization(generated, existing []byte) ([]byte, error) {
+	generatedLines := strings.SplitAfter(string(generated), "\n")
+	begin, end := findManagedBlock(generatedLines)
+	if begin < 0 || end < 0 {
+		return nil, fmt.Errorf("generated kustomization does not contain a managed block")
+	}
+	managed := generatedLines[begin : end+1]
+
+	existingLines := strings.SplitAfter(string(existing), "\n")
+	begin, end = findManagedBlock(existingLines)
+	if begin < 0 && end < 0 {
+		customized, err := isCustomized(existing)
+		if err != nil {
+			return nil, err
+		}
+		if customized {
+			return nil, fmt.Errorf("customized kustomization.yaml without managed block, please surround the generated fields with '%s' and '%s'", managedBlockBegin, managedBlockEnd)
+		}
+		return generated, nil
+	}
+	if begin < 0 || end < begin {
+		return nil, fmt.Errorf("unbalanced managed block markers")
+	}
+
+	merged := &bytes.Buffer{}
+	merged.WriteString(strings.Join(existingLines[:begin], ""))
+	merged.WriteString(strings.Join(managed, ""))
+	merged.WriteString(strings.Join(existingLines[end+1:], ""))
+
+	// duplicate keys are rejected, e.g. if a field managed by helmt was added by hand as well
+	err := yaml.UnmarshalStrict(merged.Bytes(), &map[string]interface{}{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid kustomization after merge: %v", err)
+	}
+	return merged.Bytes(), nil
+}
+
+func findManagedBlock(lines []string) (int, int) {
+	begin, end := -1, -1
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if begin < 0 && strings.HasPrefix(line, managedBlockBegin) {
+			begin = i
+		}
+		if strings.HasPrefix(line, managedBlockEnd) {
+			end = i
+		}
+	}
+	return begin, end
+}
+
+// isCustomized checks whether the kustomization contains anything else than generated by older versions of helmt.
+func isCustomized(kustomization []byte) (bool, error) {
+	fields := yaml.MapSlice{}
+	err := yaml.Unmarshal(kustomization, &fields)
+	if err != nil {
+		return false, err
+	}
+	for _, field := range fields {
+		switch field.Key {
+		case "apiVersion", "kind", "resources":
+		default:
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// generateUmbrellaKustomizationCommand writes a kustomization.yaml into outputDir referencing all chart directories
+// rendered by helmt, which contain a kustomization.yaml. Directories of deleted charts are dropped.
+func generateUmbrellaKustomizationCommand(outputDir string) error {
+	entries, err := afero.ReadDir(fs, outputDir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	resources := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		owned, err := afero.Exists(fs, filepath.Join(outputDir, entry.Name(), outputMetadataFile))
+		if err != nil {
+			return err
+		}
+		kustomized, err := afero.Exists(fs, filepath.Join(outputDir, entry.Name(), kustomizationFile))
+		if err != nil {
+			return err
+		}
+		if owned && kustomized {
+			resources = append(resources, entry.Name())
+		} else if owned {
+			color.Yellow("Warning: %s has no kustomization.yaml and is left out of the umbrella kustomization", entry.Name())
+		}
+	}
+
+	content, err := renderKustomization(resources, nil)
+	if err != nil {
+		return err
+	}
+	umbrella := filepath.Join(outputDir, kustomizationFile)
+	exists, err := afero.Exists(fs, umbrella)
+	if err != nil {
+		return err
+	}
+	if exists {
+		existing, err := afero.ReadFile(fs, umbrella)
+		if err != nil {
+			return err
+		}
+		content, err = mergeKustomization(content, existing)
+		if err != nil {
+			return fmt.Errorf("failed to preserve %s: %v", umbrella, err)
+		}
+	}
+	return afero.WriteFile(fs, umbrella, content, 0644)
+}
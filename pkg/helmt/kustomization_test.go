@@ -0,0 +1,474 @@
+package helmt
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/otiai10/copy"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func Test_generateKustomization(t *testing.T) {
+	type args struct {
+		directory string
+		options   Kustomization
+	}
+	tests := []struct {
+		name            string
+		args            args
+		expectedContent string
+		expectedNested  map[string]string
+		wantErr         bool
+	}{
+		{
+			name: "jenkins",
+			args: args{
+				directory: "testdata/jenkins",
+			},
+			expectedContent: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# helmt:begin - managed by helmt, changes within this block are overwritten
+resources:
+  - templates/config.yaml
+  - templates/home-pvc.yaml
+  - templates/jcasc-config.yaml
+  - templates/jenkins-agent-svc.yaml
+  - templates/jenkins-master-deployment.yaml
+  - templates/jenkins-master-svc.yaml
+  - templates/rbac.yaml
+  - templates/secret.yaml
+  - templates/service-account.yaml
+  - templates/tests/test-config.yaml
+# helmt:end`,
+			wantErr: false,
+		},
+		{
+			name: "prometheus-operator",
+			args: args{
+				directory: "testdata/prometheus-operator",
+			},
+			expectedContent: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# helmt:begin - managed by helmt, changes within this block are overwritten
+resources:
+  - charts/grafana/templates/clusterrole.yaml
+  - charts/grafana/templates/clusterrolebinding.yaml
+  - charts/grafana/templates/configmap-dashboard-provider.yaml
+  - charts/grafana/templates/configmap.yaml
+  - charts/grafana/templates/deployment.yaml
+  - charts/grafana/templates/ingress.yaml
+  - charts/grafana/templates/podsecuritypolicy.yaml
+  - charts/grafana/templates/role.yaml
+  - charts/grafana/templates/rolebinding.yaml
+  - charts/grafana/templates/service.yaml
+  - charts/grafana/templates/serviceaccount.yaml
+  - charts/grafana/templates/tests/test-configmap.yaml
+  - charts/grafana/templates/tests/test-podsecuritypolicy.yaml
+  - charts/grafana/templates/tests/test-role.yaml
+  - charts/grafana/templates/tests/test-rolebinding.yaml
+  - charts/grafana/templates/tests/test-serviceaccount.yaml
+  - charts/kube-state-metrics/templates/clusterrole.yaml
+  - charts/kube-state-metrics/templates/clusterrolebinding.yaml
+  - charts/kube-state-metrics/templates/deployment.yaml
+  - charts/kube-state-metrics/templates/podsecuritypolicy.yaml
+  - charts/kube-state-metrics/templates/service.yaml
+  - charts/kube-state-metrics/templates/serviceaccount.yaml
+  - charts/prometheus-node-exporter/templates/daemonset.yaml
+  - charts/prometheus-node-exporter/templates/psp-clusterrole.yaml
+  - charts/prometheus-node-exporter/templates/psp-clusterrolebinding.yaml
+  - charts/prometheus-node-exporter/templates/psp.yaml
+  - charts/prometheus-node-exporter/templates/service.yaml
+  - charts/prometheus-node-exporter/templates/serviceaccount.yaml
+  - crds/crd-alertmanager.yaml
+  - crds/crd-podmonitor.yaml
+  - crds/crd-prometheus.yaml
+  - crds/crd-prometheusrules.yaml
+  - crds/crd-servicemonitor.yaml
+  - crds/crd-thanosrulers.yaml
+  - templates/alertmanager/alertmanager.yaml
+  - templates/alertmanager/ingress.yaml
+  - templates/alertmanager/psp-role.yaml
+  - templates/alertmanager/psp-rolebinding.yaml
+  - templates/alertmanager/psp.yaml
+  - templates/alertmanager/secret.yaml
+  - templates/alertmanager/service.yaml
+  - templates/alertmanager/serviceaccount.yaml
+  - templates/alertmanager/servicemonitor.yaml
+  - templates/exporters/core-dns/service.yaml
+  - templates/exporters/core-dns/servicemonitor.yaml
+  - templates/exporters/kube-api-server/servicemonitor.yaml
+  - templates/exporters/kube-controller-manager/service.yaml
+  - templates/exporters/kube-controller-manager/servicemonitor.yaml
+  - templates/exporters/kube-etcd/service.yaml
+  - templates/exporters/kube-etcd/servicemonitor.yaml
+  - templates/exporters/kube-proxy/service.yaml
+  - templates/exporters/kube-proxy/servicemonitor.yaml
+  - templates/exporters/kube-scheduler/service.yaml
+  - templates/exporters/kube-scheduler/servicemonitor.yaml
+  - templates/exporters/kube-state-metrics/serviceMonitor.yaml
+  - templates/exporters/kubelet/servicemonitor.yaml
+  - templates/exporters/node-exporter/servicemonitor.yaml
+  - templates/grafana/configmaps-datasources.yaml
+  - templates/grafana/dashboards-1.14/apiserver.yaml
+  - templates/grafana/dashboards-1.14/cluster-total.yaml
+  - templates/grafana/dashboards-1.14/controller-manager.yaml
+  - templates/grafana/dashboards-1.14/etcd.yaml
+  - templates/grafana/dashboards-1.14/k8s-coredns.yaml
+  - templates/grafana/dashboards-1.14/k8s-resources-cluster.yaml
+  - templates/grafana/dashboards-1.14/k8s-resources-namespace.yaml
+  - templates/grafana/dashboards-1.14/k8s-resources-node.yaml
+  - templates/grafana/dashboards-1.14/k8s-resources-pod.yaml
+  - templates/grafana/dashboards-1.14/k8s-resources-workload.yaml
+  - templates/grafana/dashboards-1.14/k8s-resources-workloads-namespace.yaml
+  - templates/grafana/dashboards-1.14/kubelet.yaml
+  - templates/grafana/dashboards-1.14/namespace-by-pod.yaml
+  - templates/grafana/dashboards-1.14/namespace-by-workload.yaml
+  - templates/grafana/dashboards-1.14/node-cluster-rsrc-use.yaml
+  - templates/grafana/dashboards-1.14/node-rsrc-use.yaml
+  - templates/grafana/dashboards-1.14/nodes.yaml
+  - templates/grafana/dashboards-1.14/persistentvolumesusage.yaml
+  - templates/grafana/dashboards-1.14/pod-total.yaml
+  - templates/grafana/dashboards-1.14/pods.yaml
+  - templates/grafana/dashboards-1.14/prometheus.yaml
+  - templates/grafana/dashboards-1.14/proxy.yaml
+  - templates/grafana/dashboards-1.14/scheduler.yaml
+  - templates/grafana/dashboards-1.14/statefulset.yaml
+  - templates/grafana/dashboards-1.14/workload-total.yaml
+  - templates/grafana/servicemonitor.yaml
+  - templates/prometheus/additionalPrometheusRules.yaml
+  - templates/prometheus/clusterrole.yaml
+  - templates/prometheus/clusterrolebinding.yaml
+  - templates/prometheus/ingress.yaml
+  - templates/prometheus/prometheus.yaml
+  - templates/prometheus/psp-clusterrole.yaml
+  - templates/prometheus/psp-clusterrolebinding.yaml
+  - templates/prometheus/psp.yaml
+  - templates/prometheus/rules-1.14/alertmanager.rules.yaml
+  - templates/prometheus/rules-1.14/etcd.yaml
+  - templates/prometheus/rules-1.14/general.rules.yaml
+  - templates/prometheus/rules-1.14/k8s.rules.yaml
+  - templates/prometheus/rules-1.14/kube-apiserver-error-alerts.yaml
+  - templates/prometheus/rules-1.14/kube-apiserver-error.yaml
+  - templates/prometheus/rules-1.14/kube-apiserver-slos.yaml
+  - templates/prometheus/rules-1.14/kube-apiserver.rules.yaml
+  - templates/prometheus/rules-1.14/kube-prometheus-general.rules.yaml
+  - templates/prometheus/rules-1.14/kube-prometheus-node-recording.rules.yaml
+  - templates/prometheus/rules-1.14/kube-scheduler.rules.yaml
+  - templates/prometheus/rules-1.14/kube-state-metrics.yaml
+  - templates/prometheus/rules-1.14/kubelet.rules.yaml
+  - templates/prometheus/rules-1.14/kubernetes-absent.yaml
+  - templates/prometheus/rules-1.14/kubernetes-apps.yaml
+  - templates/prometheus/rules-1.14/kubernetes-resources.yaml
+  - templates/prometheus/rules-1.14/kubernetes-storage.yaml
+  - templates/prometheus/rules-1.14/kubernetes-system-apiserver.yaml
+  - templates/prometheus/rules-1.14/kubernetes-system-controller-manager.yaml
+  - templates/prometheus/rules-1.14/kubernetes-system-kubelet.yaml
+  - templates/prometheus/rules-1.14/kubernetes-system-scheduler.yaml
+  - templates/prometheus/rules-1.14/kubernetes-system.yaml
+  - templates/prometheus/rules-1.14/node-exporter.rules.yaml
+  - templates/prometheus/rules-1.14/node-exporter.yaml
+  - templates/prometheus/rules-1.14/node-network.yaml
+  - templates/prometheus/rules-1.14/node-time.yaml
+  - templates/prometheus/rules-1.14/node.rules.yaml
+  - templates/prometheus/rules-1.14/prometheus-operator.yaml
+  - templates/prometheus/rules-1.14/prometheus.yaml
+  - templates/prometheus/service.yaml
+  - templates/prometheus/serviceaccount.yaml
+  - templates/prometheus/servicemonitor.yaml
+  - templates/prometheus-operator/admission-webhooks/mutatingWebhookConfiguration.yaml
+  - templates/prometheus-operator/admission-webhooks/validatingWebhookConfiguration.yaml
+  - templates/prometheus-operator/clusterrole.yaml
+  - templates/prometheus-operator/clusterrolebinding.yaml
+  - templates/prometheus-operator/deployment.yaml
+  - templates/prometheus-operator/psp-clusterrole.yaml
+  - templates/prometheus-operator/psp-clusterrolebinding.yaml
+  - templates/prometheus-operator/psp.yaml
+  - templates/prometheus-operator/service.yaml
+  - templates/prometheus-operator/serviceaccount.yaml
+  - templates/prometheus-operator/servicemonitor.yaml
+# helmt:end`,
+			wantErr: false,
+		},
+		{
+			name: "kustomization fields",
+			args: args{
+				directory: "testdata/mixed-crds",
+				options: Kustomization{
+					Namespace:         "backup",
+					NamePrefix:        "prod-",
+					CommonLabels:      map[string]string{"app": "backup"},
+					CommonAnnotations: map[string]string{"owner": "platform"},
+					Images:            []KustomizeImage{{Name: "operator", NewName: "mirror.local/operator", NewTag: "1.2.3"}},
+					Patches: []yaml.MapSlice{{
+						{Key: "target", Value: yaml.MapSlice{{Key: "kind", Value: "Deployment"}}},
+						{Key: "patch", Value: "- op: remove\n  path: /spec/replicas\n"},
+					}},
+				},
+			},
+			expectedContent: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# helmt:begin - managed by helmt, changes within this block are overwritten
+namespace: backup
+namePrefix: prod-
+commonLabels:
+  app: backup
+commonAnnotations:
+  owner: platform
+resources:
+  - crds/crd-backups.yaml
+  - templates/bundle.yaml
+  - templates/deployment.yaml
+images:
+- name: operator
+  newName: mirror.local/operator
+  newTag: 1.2.3
+patches:
+- target:
+    kind: Deployment
+  patch: |
+    - op: remove
+      path: /spec/replicas
+# helmt:end`,
+		},
+		{
+			name: "kustomization per directory",
+			args: args{
+				directory: "testdata/mixed-crds",
+				options: Kustomization{
+					CommonLabels: map[string]string{"app": "backup"},
+					PerDirectory: true,
+				},
+			},
+			expectedContent: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# helmt:begin - managed by helmt, changes within this block are overwritten
+commonLabels:
+  app: backup
+resources:
+  - crds
+  - templates
+# helmt:end`,
+			expectedNested: map[string]string{
+				"crds": `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# helmt:begin - managed by helmt, changes within this block are overwritten
+resources:
+  - crd-backups.yaml
+# helmt:end`,
+				"templates": `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# helmt:begin - managed by helmt, changes within this block are overwritten
+resources:
+  - bundle.yaml
+  - deployment.yaml
+# helmt:end`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs = afero.NewOsFs()
+			dir, err := ioutil.TempDir("", "kustomization")
+			assert.NoError(t, err)
+			err = copy.Copy(tt.args.directory, dir)
+			assert.NoError(t, err)
+
+			require.NoError(t, afero.WriteFile(fs, path.Join(dir, "Chart.yaml"), []byte("apiVersion: v2\nname: chart\nversion: 1.0.0\n"), os.ModePerm))
+			require.NoError(t, afero.WriteFile(fs, path.Join(dir, "NOTES.txt"), []byte("thank you"), os.ModePerm))
+
+			if err := generateKustomizationCommand(dir, tt.args.options); (err != nil) != tt.wantErr {
+				t.Errorf("generateKustomizationCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			kustomization := path.Join(dir, "kustomization.yaml")
+			stat, err := fs.Stat(kustomization)
+			require.NoError(t, err)
+
+			assert.False(t, stat.IsDir())
+			assert.Equal(t, tt.expectedContent, ReadFileAsString(t, kustomization))
+			for nested, expectedContent := range tt.expectedNested {
+				assert.Equal(t, expectedContent, ReadFileAsString(t, path.Join(dir, nested, "kustomization.yaml")))
+			}
+		})
+	}
+}
+
+func Test_mergeKustomization(t *testing.T) {
+	generated := `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# helmt:begin - managed by helmt, changes within this block are overwritten
+resources:
+  - templates/deployment.yaml
+  - templates/service.yaml
+# helmt:end
+`
+	tests := []struct {
+		name     string
+		existing string
+		expected string
+		wantErr  bool
+	}{
+		{
+			name: "customizations around the managed block are kept",
+			existing: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# our own patches
+patchesStrategicMerge:
+  - replicas.yaml
+# helmt:begin - managed by helmt, changes within this block are overwritten
+resources:
+  - templates/deployment.yaml
+# helmt:end
+transformers:
+  - labels.yaml
+`,
+			expected: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# our own patches
+patchesStrategicMerge:
+  - replicas.yaml
+# helmt:begin - managed by helmt, changes within this block are overwritten
+resources:
+  - templates/deployment.yaml
+  - templates/service.yaml
+# helmt:end
+transformers:
+  - labels.yaml
+`,
+		},
+		{
+			name: "kustomization generated by older versions is replaced",
+			existing: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+  - templates/deployment.yaml
+`,
+			expected: generated,
+		},
+		{
+			name: "customized kustomization without managed block",
+			existing: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+  - templates/deployment.yaml
+namePrefix: prod-
+`,
+			wantErr: true,
+		},
+		{
+			name: "managed field added by hand",
+			existing: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+  - extra.yaml
+# helmt:begin
+# helmt:end
+`,
+			wantErr: true,
+		},
+		{
+			name: "missing end marker",
+			existing: `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# helmt:begin
+resources:
+  - templates/deployment.yaml
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, err := mergeKustomization([]byte(generated), []byte(tt.existing))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, string(merged))
+		})
+	}
+}
+
+func Test_preserveKustomizations(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/temp/helmt-123/jenkins/kustomization.yaml", []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# helmt:begin
+resources:
+  - templates/config.yaml
+# helmt:end
+`), os.ModePerm))
+	require.NoError(t, afero.WriteFile(fs, "/temp/helmt-123/jenkins/templates/kustomization.yaml", []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# helmt:begin
+resources:
+  - config.yaml
+# helmt:end
+`), os.ModePerm))
+	require.NoError(t, afero.WriteFile(fs, "manifests/jenkins/kustomization.yaml", []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+namePrefix: prod-
+# helmt:begin
+resources:
+  - templates/old.yaml
+# helmt:end
+`), os.ModePerm))
+
+	err := preserveKustomizations("/temp/helmt-123/jenkins", "manifests/jenkins")
+	require.NoError(t, err)
+
+	assert.Equal(t, `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+namePrefix: prod-
+# helmt:begin
+resources:
+  - templates/config.yaml
+# helmt:end`, ReadFileAsString(t, "/temp/helmt-123/jenkins/kustomization.yaml"))
+	assert.Equal(t, `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# helmt:begin
+resources:
+  - config.yaml
+# helmt:end`, ReadFileAsString(t, "/temp/helmt-123/jenkins/templates/kustomization.yaml"))
+}
+
+func Test_generateUmbrellaKustomization(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	kustomization := []byte("apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\n")
+	metadata := []byte("chart: chart\n")
+	// rendered by helmt with kustomization
+	require.NoError(t, afero.WriteFile(fs, "manifests/jenkins/kustomization.yaml", kustomization, os.ModePerm))
+	require.NoError(t, afero.WriteFile(fs, "manifests/jenkins/.helmt-metadata.yaml", metadata, os.ModePerm))
+	require.NoError(t, afero.WriteFile(fs, "manifests/cert-manager-crds/kustomization.yaml", kustomization, os.ModePerm))
+	require.NoError(t, afero.WriteFile(fs, "manifests/cert-manager-crds/.helmt-metadata.yaml", metadata, os.ModePerm))
+	// rendered by helmt without kustomization
+	require.NoError(t, afero.WriteFile(fs, "manifests/grafana/.helmt-metadata.yaml", metadata, os.ModePerm))
+	// not owned by helmt
+	require.NoError(t, afero.WriteFile(fs, "manifests/hand-written/kustomization.yaml", kustomization, os.ModePerm))
+	require.NoError(t, afero.WriteFile(fs, "manifests/kustomization.yaml", []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+namespace: infra
+# helmt:begin
+resources:
+  - deleted-chart
+  - jenkins
+# helmt:end
+`), os.ModePerm))
+
+	err := generateUmbrellaKustomizationCommand("manifests")
+	require.NoError(t, err)
+
+	assert.Equal(t, `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+namespace: infra
+# helmt:begin - managed by helmt, changes within this block are overwritten
+resources:
+  - cert-manager-crds
+  - jenkins
+# helmt:end`, ReadFileAsString(t, "manifests/kustomization.yaml"))
+}
@@ -0,0 +1,110 @@
+package helmt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v2"
+)
+
+var documentSeparator = regexp.MustCompile(`(?m)^---[ \t]*\n?`)
+
+type manifestHeader struct {
+	ApiVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+}
+
+// splitDocuments splits a multi document yaml file into its documents.
+// Documents consisting only of comments or whitespace are dropped.
+func splitDocuments(content []byte) [][]byte {
+	var documents [][]byte
+	for _, document := range documentSeparator.Split(string(content), -1) {
+		if isEmptyDocument(document) {
+			continue
+		}
+		documents = append(documents, []byte(document))
+	}
+	return documents
+}
+
+func isEmptyDocument(document string) bool {
+	for _, line := range strings.Split(document, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
+
+// joinDocuments is the inverse of splitDocuments.
+func joinDocuments(documents [][]byte) []byte {
+	buffer := &bytes.Buffer{}
+	for _, document := range documents {
+		buffer.WriteString("---\n")
+		buffer.Write(bytes.TrimRight(document, "\n"))
+		buffer.WriteString("\n")
+	}
+	return buffer.Bytes()
+}
+
+func parseManifestHeader(document []byte) (*manifestHeader, error) {
+	header := &manifestHeader{}
+	err := yaml.Unmarshal(document, header)
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func isManifestFile(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// walkManifests calls walkFn for every yaml file below directory in lexical order.
+func walkManifests(directory string, walkFn func(path string, documents [][]byte) error) error {
+	return afero.Walk(fs, directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isManifestFile(path) {
+			return nil
+		}
+		content, err := afero.ReadFile(fs, path)
+		if err != nil {
+			return err
+		}
+		return walkFn(path, splitDocuments(content))
+	})
+}
+
+// parseManifest parses a document into a generic structure.
+func parseManifest(document []byte) (map[interface{}]interface{}, error) {
+	manifest := map[interface{}]interface{}{}
+	err := yaml.Unmarshal(document, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// lookup returns the value at the given path of nested maps or nil if it does not exist.
+func lookup(value interface{}, path ...string) interface{} {
+	for _, key := range path {
+		m, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
@@ -0,0 +1,55 @@
+package helmt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_splitDocuments(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected []string
+	}{
+		{
+			name:     "empty file",
+			content:  "",
+			expected: nil,
+		},
+		{
+			name:     "single document without separator",
+			content:  "apiVersion: v1\nkind: ConfigMap\n",
+			expected: []string{"apiVersion: v1\nkind: ConfigMap\n"},
+		},
+		{
+			name:     "comments only documents are dropped",
+			content:  "---\n# Source: chart/templates/empty.yaml\n---\napiVersion: v1\nkind: Service\n---\n",
+			expected: []string{"apiVersion: v1\nkind: Service\n"},
+		},
+		{
+			name:     "multiple documents",
+			content:  "---\n# Source: a.yaml\nkind: A\n---\n# Source: b.yaml\nkind: B\n",
+			expected: []string{"# Source: a.yaml\nkind: A\n", "# Source: b.yaml\nkind: B\n"},
+		},
+		{
+			name:     "separator inside block scalar is not at line start",
+			content:  "kind: ConfigMap\ndata:\n  file: |\n    ---\n    nested\n",
+			expected: []string{"kind: ConfigMap\ndata:\n  file: |\n    ---\n    nested\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var actual []string
+			for _, document := range splitDocuments([]byte(tt.content)) {
+				actual = append(actual, string(document))
+			}
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func Test_joinDocuments(t *testing.T) {
+	joined := joinDocuments([][]byte{[]byte("kind: A\n"), []byte("kind: B")})
+	assert.Equal(t, "---\nkind: A\n---\nkind: B\n", string(joined))
+}
@@ -0,0 +1,39 @@
+package helmt
+
+import (
+	"path/filepath"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v2"
+)
+
+// outputMetadataFile marks a directory as rendered by helmt and records what has been rendered into it.
+const outputMetadataFile = ".helmt-metadata.yaml"
+
+type outputMetadata struct {
+	Chart      string `yaml:"chart"`
+	Version    string `yaml:"version"`
+	Repository string `yaml:"repository"`
+	Name       string `yaml:"name"`
+	// Verification is the result of the provenance verification, if enabled
+	Verification *verificationResult `yaml:"verification,omitempty"`
+}
+
+func writeOutputMetadata(directory string, chart *HelmChart, verification *verificationResult) error {
+	content, err := yaml.Marshal(outputMetadata{
+		Chart:        chart.Chart,
+		Version:      chart.Version,
+		Repository:   chart.Repository,
+		Name:         chart.Name,
+		Verification: verification,
+	})
+	if err != nil {
+		return err
+	}
+	err = fs.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+	content = append([]byte("# generated by helmt, do not edit\n"), content...)
+	return afero.WriteFile(fs, filepath.Join(directory, outputMetadataFile), content, 0644)
+}
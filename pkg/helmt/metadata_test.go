@@ -0,0 +1,60 @@
+package helmt
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_writeOutputMetadata(t *testing.T) {
+	fs = afero.NewMemMapFs()
+
+	err := writeOutputMetadata("/temp/helmt-123/jenkins", &HelmChart{
+		Chart:      "jenkins",
+		Version:    "2.0.0",
+		Repository: "https://kubernetes-charts.storage.googleapis.com",
+		Name:       "my-jenkins",
+		Namespace:  "jenkins",
+	}, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, `# generated by helmt, do not edit
+chart: jenkins
+version: 2.0.0
+repository: https://kubernetes-charts.storage.googleapis.com
+name: my-jenkins`, ReadFileAsString(t, "/temp/helmt-123/jenkins/.helmt-metadata.yaml"))
+}
+
+func Test_writeOutputMetadataWithVerification(t *testing.T) {
+	fs = afero.NewMemMapFs()
+
+	err := writeOutputMetadata("/temp/helmt-123/jenkins", &HelmChart{
+		Chart:      "jenkins",
+		Version:    "2.0.0",
+		Repository: "https://kubernetes-charts.storage.googleapis.com",
+		Name:       "my-jenkins",
+	}, &verificationResult{
+		Mode:        "enforce",
+		Status:      "verified",
+		Key:         "keys/pubring.gpg",
+		SignedBy:    "Jenkins Maintainers <jenkins@example.com>",
+		Fingerprint: "5E615389B53CA37F0EE60BD3843BBF981FC18762",
+		Digest:      "sha256:1111",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, `# generated by helmt, do not edit
+chart: jenkins
+version: 2.0.0
+repository: https://kubernetes-charts.storage.googleapis.com
+name: my-jenkins
+verification:
+  mode: enforce
+  status: verified
+  key: keys/pubring.gpg
+  signedBy: Jenkins Maintainers <jenkins@example.com>
+  fingerprint: 5E615389B53CA37F0EE60BD3843BBF981FC18762
+  digest: sha256:1111`, ReadFileAsString(t, "/temp/helmt-123/jenkins/.helmt-metadata.yaml"))
+}
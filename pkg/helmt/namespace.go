@@ -0,0 +1,49 @@
+package helmt
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v2"
+)
+
+type namespaceManifest struct {
+	ApiVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   namespaceMetadata `yaml:"metadata"`
+}
+
+type namespaceMetadata struct {
+	Name        string            `yaml:"name"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// generateNamespaceCommand writes a Namespace manifest into the rendered chart directory,
+// so that it is picked up by the kustomization like any other template.
+func generateNamespaceCommand(directory, namespace string, labels, annotations map[string]string) error {
+	manifest := namespaceManifest{
+		ApiVersion: "v1",
+		Kind:       "Namespace",
+		Metadata: namespaceMetadata{
+			Name:        namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+	}
+	content, err := yaml.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	err = fs.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+	err = afero.WriteFile(fs, path.Join(directory, "namespace.yaml"), append([]byte("---\n"), content...), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write namespace manifest: %v", err)
+	}
+	return nil
+}
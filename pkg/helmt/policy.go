@@ -0,0 +1,393 @@
+package helmt
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+const (
+	policiesKey = "policies"
+
+	severityError   = "error"
+	severityWarning = "warning"
+	severityInfo    = "info"
+	severityOff     = "off"
+)
+
+// Policies configures the checks of the rendered workloads. They can be set in the spec and in the config file,
+// settings of the spec take precedence.
+type Policies struct {
+	// Enabled is a pointer, so that the spec can disable the checks enabled in the config file
+	Enabled *bool `yaml:"enabled" mapstructure:"enabled"`
+	// Format of the report, either text or sarif
+	Format string `yaml:"format" mapstructure:"format" validate:"omitempty,oneof=text sarif"`
+	// ReportFile receives the report instead of stdout
+	ReportFile        string   `yaml:"reportFile" mapstructure:"reportFile"`
+	AllowedRegistries []string `yaml:"allowedRegistries" mapstructure:"allowedRegistries"`
+	// Rules overwrite the severity of rules by their id
+	Rules map[string]string `yaml:"rules" mapstructure:"rules" validate:"dive,oneof=error warning info off"`
+}
+
+type policyRule struct {
+	ID          string
+	Description string
+	Severity    string
+	check       func(workload policyWorkload, policies Policies) []string
+}
+
+type policyWorkload struct {
+	manifest map[interface{}]interface{}
+	podSpec  map[interface{}]interface{}
+}
+
+type policyFinding struct {
+	Rule     *policyRule
+	Severity string
+	File     string
+	Document int
+	Resource string
+	Message  string
+}
+
+var policyRules = []*policyRule{
+	{
+		ID:          "privileged-container",
+		Description: "Containers must not run privileged",
+		Severity:    severityError,
+		check: func(workload policyWorkload, _ Policies) []string {
+			var messages []string
+			_ = visitContainers(workload.manifest, func(_ map[interface{}]interface{}, _ string, container map[interface{}]interface{}) error {
+				if privileged, _ := lookup(container, "securityContext", "privileged").(bool); privileged {
+					messages = append(messages, fmt.Sprintf("container %v runs privileged", container["name"]))
+				}
+				return nil
+			})
+			return messages
+		},
+	},
+	{
+		ID:          "host-path-volume",
+		Description: "Pods must not mount hostPath volumes",
+		Severity:    severityError,
+		check: func(workload policyWorkload, _ Policies) []string {
+			var messages []string
+			volumes, _ := workload.podSpec["volumes"].([]interface{})
+			for _, volume := range volumes {
+				if lookup(volume, "hostPath") != nil {
+					messages = append(messages, fmt.Sprintf("volume %v uses hostPath %v", lookup(volume, "name"), lookup(volume, "hostPath", "path")))
+				}
+			}
+			return messages
+		},
+	},
+	{
+		ID:          "missing-resource-requests",
+		Description: "Containers must request cpu and memory",
+		Severity:    severityWarning,
+		check: func(workload policyWorkload, _ Policies) []string {
+			var messages []string
+			_ = visitContainers(workload.manifest, func(_ map[interface{}]interface{}, containerType string, container map[interface{}]interface{}) error {
+				if containerType == "ephemeralContainers" {
+					return nil
+				}
+				for _, resource := range []string{"cpu", "memory"} {
+					if lookup(container, "resources", "requests", resource) == nil {
+						messages = append(messages, fmt.Sprintf("container %v does not request %s", container["name"], resource))
+					}
+				}
+				return nil
+			})
+			return messages
+		},
+	},
+	{
+		ID:          "latest-tag",
+		Description: "Images must use a fixed tag or digest",
+		Severity:    severityWarning,
+		check: func(workload policyWorkload, _ Policies) []string {
+			var messages []string
+			_ = visitContainers(workload.manifest, func(_ map[interface{}]interface{}, _ string, container map[interface{}]interface{}) error {
+				image, _ := container["image"].(string)
+				ref := parseImageReference(image)
+				if image != "" && ref.Digest == "" && ref.Tag == "latest" {
+					messages = append(messages, fmt.Sprintf("container %v uses image %s without fixed tag", container["name"], image))
+				}
+				return nil
+			})
+			return messages
+		},
+	},
+	{
+		ID:          "disallowed-registry",
+		Description: "Images must be pulled from the allowed registries",
+		Severity:    severityError,
+		check: func(workload policyWorkload, policies Policies) []string {
+			if len(policies.AllowedRegistries) == 0 {
+				return nil
+			}
+			var messages []string
+			_ = visitContainers(workload.manifest, func(_ map[interface{}]interface{}, _ string, container map[interface{}]interface{}) error {
+				image, _ := container["image"].(string)
+				if image == "" {
+					return nil
+				}
+				for _, registry := range policies.AllowedRegistries {
+					if isAllowedRegistry(image, registry) {
+						return nil
+					}
+				}
+				messages = append(messages, fmt.Sprintf("container %v uses image %s from a registry which is not allowed", container["name"], image))
+				return nil
+			})
+			return messages
+		},
+	},
+}
+
+// mergePolicies combines the policies of the config file with the ones of the spec.
+func mergePolicies(spec Policies) (Policies, error) {
+	global := Policies{}
+	err := viper.UnmarshalKey(policiesKey, &global)
+	if err != nil {
+		return Policies{}, fmt.Errorf("invalid policies in config: %v", err)
+	}
+
+	merged := Policies{
+		Enabled:           firstBool(spec.Enabled, global.Enabled),
+		Format:            firstNonEmpty(spec.Format, global.Format, "text"),
+		ReportFile:        firstNonEmpty(spec.ReportFile, global.ReportFile),
+		AllowedRegistries: spec.AllowedRegistries,
+		Rules:             map[string]string{},
+	}
+	if len(merged.AllowedRegistries) == 0 {
+		merged.AllowedRegistries = global.AllowedRegistries
+	}
+	for _, rule := range policyRules {
+		merged.Rules[rule.ID] = rule.Severity
+	}
+	for _, rules := range []map[string]string{global.Rules, spec.Rules} {
+		for id, severity := range rules {
+			if _, ok := merged.Rules[id]; !ok {
+				return Policies{}, fmt.Errorf("unknown policy rule '%s'", id)
+			}
+			merged.Rules[id] = severity
+		}
+	}
+	err = validate.Struct(merged)
+	if err != nil {
+		return Policies{}, fmt.Errorf("invalid policies: %v", err)
+	}
+	return merged, nil
+}
+
+// isAllowedRegistry checks whether image is pulled from registry. registry is a host like mirror.example.com,
+// optionally followed by a path prefix like mirror.example.com/team/, which has to match whole path segments.
+func isAllowedRegistry(image, registry string) bool {
+	ref := parseImageReference(image)
+	host := ref.Registry
+	if host == dockerHubRegistry {
+		host = "docker.io"
+	}
+	allowed := strings.SplitN(strings.TrimSuffix(registry, "/"), "/", 2)
+	if !strings.EqualFold(host, allowed[0]) {
+		return false
+	}
+	if len(allowed) == 1 {
+		return true
+	}
+	return ref.Repository == allowed[1] || strings.HasPrefix(ref.Repository, allowed[1]+"/")
+}
+
+// firstBool returns the first value which is set, false if none is set.
+func firstBool(values ...*bool) *bool {
+	for _, value := range values {
+		if value != nil {
+			return value
+		}
+	}
+	disabled := false
+	return &disabled
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// checkPoliciesCommand runs all enabled rules against the workloads rendered into directory and reports the findings.
+// target is the directory the chart is moved to, it is used to reference the files in the report.
+// Findings with severity error fail the check.
+func checkPoliciesCommand(directory, target string, spec Policies) error {
+	policies, err := mergePolicies(spec)
+	if err != nil {
+		return err
+	}
+	if !*policies.Enabled {
+		return nil
+	}
+
+	var findings []policyFinding
+	err = walkManifests(directory, func(path string, documents [][]byte) error {
+		rel, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		for i, document := range documents {
+			manifest, err := parseManifest(document)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", path, err)
+			}
+			kind, _ := manifest["kind"].(string)
+			specPath := podSpecPath(kind)
+			if specPath == nil {
+				continue
+			}
+			podSpec, _ := lookup(manifest, specPath...).(map[interface{}]interface{})
+			workload := policyWorkload{manifest: manifest, podSpec: podSpec}
+			for _, rule := range policyRules {
+				severity := policies.Rules[rule.ID]
+				if severity == severityOff {
+					continue
+				}
+				for _, message := range rule.check(workload, policies) {
+					findings = append(findings, policyFinding{
+						Rule:     rule,
+						Severity: severity,
+						File:     filepath.ToSlash(filepath.Join(target, rel)),
+						Document: i + 1,
+						Resource: fmt.Sprintf("%s/%v", kind, lookup(manifest, "metadata", "name")),
+						Message:  message,
+					})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var report []byte
+	if policies.Format == "sarif" {
+		report, err = sarifReport(findings)
+		if err != nil {
+			return err
+		}
+	} else {
+		report = textReport(findings)
+	}
+	if policies.ReportFile != "" {
+		err = afero.WriteFile(fs, policies.ReportFile, report, 0644)
+	} else {
+		_, err = Output.Write(report)
+	}
+	if err != nil {
+		return err
+	}
+
+	errors := 0
+	for _, finding := range findings {
+		if finding.Severity == severityError {
+			errors++
+		}
+	}
+	if errors > 0 {
+		return fmt.Errorf("%d policy violations with severity error found", errors)
+	}
+	return nil
+}
+
+func textReport(findings []policyFinding) []byte {
+	builder := &strings.Builder{}
+	for _, finding := range findings {
+		builder.WriteString(fmt.Sprintf("%s: %s (document %d) %s: %s [%s]\n",
+			strings.ToUpper(finding.Severity), finding.File, finding.Document, finding.Resource, finding.Message, finding.Rule.ID))
+	}
+	return []byte(builder.String())
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool struct {
+		Driver struct {
+			Name           string      `json:"name"`
+			InformationURI string      `json:"informationUri"`
+			Rules          []sarifRule `json:"rules"`
+		} `json:"driver"`
+	} `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+	} `json:"physicalLocation"`
+}
+
+func sarifReport(findings []policyFinding) ([]byte, error) {
+	run := sarifRun{Results: []sarifResult{}}
+	run.Tool.Driver.Name = "helmt"
+	run.Tool.Driver.InformationURI = "https://github.com/syncier/helmt"
+	for _, rule := range policyRules {
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{ID: rule.ID, ShortDescription: sarifMessage{Text: rule.Description}})
+	}
+	for _, finding := range findings {
+		level := finding.Severity
+		if level == severityInfo {
+			level = "note"
+		}
+		result := sarifResult{
+			RuleID:    finding.Rule.ID,
+			Level:     level,
+			Message:   sarifMessage{Text: fmt.Sprintf("%s (document %d): %s", finding.Resource, finding.Document, finding.Message)},
+			Locations: []sarifLocation{{}},
+		}
+		result.Locations[0].PhysicalLocation.ArtifactLocation.URI = finding.File
+		run.Results = append(run.Results, result)
+	}
+	sort.SliceStable(run.Results, func(i, j int) bool {
+		return run.Results[i].Locations[0].PhysicalLocation.ArtifactLocation.URI < run.Results[j].Locations[0].PhysicalLocation.ArtifactLocation.URI
+	})
+	content, err := json.MarshalIndent(sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(content, '\n'), nil
+}
@@ -0,0 +1,222 @@
+package helmt
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_mergePolicies(t *testing.T) {
+	tests := []struct {
+		name       string
+		configFile string
+		spec       Policies
+		expected   Policies
+		wantErr    string
+	}{
+		{
+			name: "defaults",
+			spec: Policies{Enabled: boolPtr(true)},
+			expected: Policies{
+				Enabled: boolPtr(true),
+				Format:  "text",
+				Rules: map[string]string{
+					"privileged-container":      "error",
+					"host-path-volume":          "error",
+					"missing-resource-requests": "warning",
+					"latest-tag":                "warning",
+					"disallowed-registry":       "error",
+				},
+			},
+		},
+		{
+			name:       "spec overrides config",
+			configFile: "testdata/helmt-config.yaml",
+			spec: Policies{
+				Rules: map[string]string{"host-path-volume": "info"},
+			},
+			expected: Policies{
+				Enabled:           boolPtr(true),
+				Format:            "sarif",
+				ReportFile:        "testdata/policy-report.sarif",
+				AllowedRegistries: []string{"mirror.example.com/"},
+				Rules: map[string]string{
+					"privileged-container":      "error",
+					"host-path-volume":          "info",
+					"missing-resource-requests": "off",
+					"latest-tag":                "warning",
+					"disallowed-registry":       "error",
+				},
+			},
+		},
+		{
+			name:       "spec disables config",
+			configFile: "testdata/helmt-config.yaml",
+			spec:       Policies{Enabled: boolPtr(false)},
+			expected: Policies{
+				Enabled:           boolPtr(false),
+				Format:            "sarif",
+				ReportFile:        "testdata/policy-report.sarif",
+				AllowedRegistries: []string{"mirror.example.com/"},
+				Rules: map[string]string{
+					"privileged-container":      "error",
+					"host-path-volume":          "error",
+					"missing-resource-requests": "off",
+					"latest-tag":                "warning",
+					"disallowed-registry":       "error",
+				},
+			},
+		},
+		{
+			name:    "unknown rule",
+			spec:    Policies{Rules: map[string]string{"no-root": "error"}},
+			wantErr: "unknown policy rule 'no-root'",
+		},
+		{
+			name:    "invalid severity",
+			spec:    Policies{Rules: map[string]string{"latest-tag": "fatal"}},
+			wantErr: "invalid policies: Key: 'Policies.Rules[latest-tag]' Error:Field validation for 'Rules[latest-tag]' failed on the 'oneof' tag",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.configFile != "" {
+				require.NoError(t, MergeConfigFile(tt.configFile))
+				defer viper.Reset()
+			}
+			actual, err := mergePolicies(tt.spec)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func boolPtr(value bool) *bool {
+	return &value
+}
+
+func Test_isAllowedRegistry(t *testing.T) {
+	tests := []struct {
+		image    string
+		registry string
+		want     bool
+	}{
+		{image: "mirror.local/app:1.0", registry: "mirror.local", want: true},
+		{image: "mirror.local/app:1.0", registry: "mirror.local/", want: true},
+		{image: "mirror.local.evil.com/app:1.0", registry: "mirror.local"},
+		{image: "mirror.local:5000/app:1.0", registry: "mirror.local"},
+		{image: "mirror.local/team/app:1.0", registry: "mirror.local/team/", want: true},
+		{image: "mirror.local/team-evil/app:1.0", registry: "mirror.local/team"},
+		{image: "nginx:1.19", registry: "docker.io/library", want: true},
+		{image: "nginx:1.19", registry: "mirror.local"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image+" "+tt.registry, func(t *testing.T) {
+			assert.Equal(t, tt.want, isAllowedRegistry(tt.image, tt.registry))
+		})
+	}
+}
+
+func Test_checkPolicies(t *testing.T) {
+	tests := []struct {
+		name           string
+		policies       Policies
+		expectedReport string
+		wantErr        string
+	}{
+		{
+			name:     "disabled",
+			policies: Policies{},
+		},
+		{
+			name:     "defaults",
+			policies: Policies{Enabled: boolPtr(true)},
+			expectedReport: `WARNING: charts/agent/templates/cronjob.yaml (document 1) CronJob/cleanup: container cleanup does not request cpu [missing-resource-requests]
+ERROR: charts/agent/templates/deployment.yaml (document 1) Deployment/agent: container agent runs privileged [privileged-container]
+ERROR: charts/agent/templates/deployment.yaml (document 1) Deployment/agent: volume docker-socket uses hostPath /var/run/docker.sock [host-path-volume]
+WARNING: charts/agent/templates/deployment.yaml (document 1) Deployment/agent: container agent uses image mirror.example.com/agent:latest without fixed tag [latest-tag]
+`,
+			wantErr: "2 policy violations with severity error found",
+		},
+		{
+			name: "allowed registries",
+			policies: Policies{
+				Enabled:           boolPtr(true),
+				AllowedRegistries: []string{"mirror.example.com/"},
+				Rules: map[string]string{
+					"privileged-container":      "off",
+					"host-path-volume":          "warning",
+					"missing-resource-requests": "off",
+					"latest-tag":                "info",
+				},
+			},
+			expectedReport: `ERROR: charts/agent/templates/cronjob.yaml (document 1) CronJob/cleanup: container cleanup uses image busybox:1.34 from a registry which is not allowed [disallowed-registry]
+WARNING: charts/agent/templates/deployment.yaml (document 1) Deployment/agent: volume docker-socket uses hostPath /var/run/docker.sock [host-path-volume]
+INFO: charts/agent/templates/deployment.yaml (document 1) Deployment/agent: container agent uses image mirror.example.com/agent:latest without fixed tag [latest-tag]
+`,
+			wantErr: "1 policy violations with severity error found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs = afero.NewOsFs()
+			output := &bytes.Buffer{}
+			previous := Output
+			Output = output
+			defer func() { Output = previous }()
+			err := checkPoliciesCommand("testdata/policies", "charts/agent", tt.policies)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.expectedReport, output.String())
+		})
+	}
+}
+
+func Test_checkPoliciesSarif(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/rendered/templates/deployment.yaml", []byte(`---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: agent
+spec:
+  template:
+    spec:
+      containers:
+        - name: agent
+          image: agent:latest
+`), 0644))
+
+	err := checkPoliciesCommand("/rendered", "charts/agent", Policies{
+		Enabled:    boolPtr(true),
+		Format:     "sarif",
+		ReportFile: "/report.sarif",
+		Rules:      map[string]string{"missing-resource-requests": "off"},
+	})
+	assert.NoError(t, err)
+
+	content, err := afero.ReadFile(fs, "/report.sarif")
+	require.NoError(t, err)
+	report := sarifLog{}
+	require.NoError(t, json.Unmarshal(content, &report))
+	assert.Equal(t, "2.1.0", report.Version)
+	require.Len(t, report.Runs, 1)
+	assert.Len(t, report.Runs[0].Tool.Driver.Rules, len(policyRules))
+	require.Len(t, report.Runs[0].Results, 1)
+	result := report.Runs[0].Results[0]
+	assert.Equal(t, "latest-tag", result.RuleID)
+	assert.Equal(t, "warning", result.Level)
+	assert.Equal(t, "charts/agent/templates/deployment.yaml", result.Locations[0].PhysicalLocation.ArtifactLocation.URI)
+}
@@ -0,0 +1,78 @@
+package helmt
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const redacted = "*****"
+
+// redactions holds secret values which must not appear in anything helmt writes to Output or Error.
+var redactions = &redactor{}
+
+type redactor struct {
+	mutex  sync.Mutex
+	values []string
+}
+
+// add registers values to be redacted, values shorter than four characters are ignored to keep the output readable.
+func (r *redactor) add(values ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, value := range values {
+		if len(value) < 4 || containsString(r.values, value) {
+			continue
+		}
+		r.values = append(r.values, value)
+	}
+	// replace longer values first, a value might contain another one
+	sort.SliceStable(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j])
+	})
+}
+
+func (r *redactor) redact(text string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, value := range r.values {
+		text = strings.ReplaceAll(text, value, redacted)
+	}
+	return text
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// redactingWriter masks registered secret values before passing the output on.
+type redactingWriter struct {
+	writer io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	_, err := w.writer.Write([]byte(redactions.redact(string(p))))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// RedactError masks registered secret values in the message of err.
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	message := redactions.redact(err.Error())
+	if message == err.Error() {
+		return err
+	}
+	return errors.New(message)
+}
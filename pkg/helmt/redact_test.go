@@ -0,0 +1,32 @@
+package helmt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_redactor(t *testing.T) {
+	r := &redactor{}
+	r.add("abc", "secret", "topsecret", "secret")
+	assert.Equal(t, []string{"topsecret", "secret"}, r.values)
+	assert.Equal(t, "abc ***** *****", r.redact("abc topsecret secret"))
+}
+
+func Test_redactingWriter(t *testing.T) {
+	previous := redactions
+	redactions = &redactor{}
+	defer func() { redactions = previous }()
+	redactions.add("hunter22")
+
+	output := &bytes.Buffer{}
+	n, err := redactingWriter{output}.Write([]byte("password hunter22\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 18, n)
+	assert.Equal(t, "password *****\n", output.String())
+
+	assert.EqualError(t, RedactError(errors.New("login with hunter22 failed")), "login with ***** failed")
+	assert.NoError(t, RedactError(nil))
+}
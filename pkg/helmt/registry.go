@@ -0,0 +1,244 @@
+package helmt
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	dockerHubRegistry = "registry-1.docker.io"
+	dockerHubIndex    = "index.docker.io"
+)
+
+var (
+	registryClient = http.DefaultClient
+	authParameter  = regexp.MustCompile(`(\w+)="([^"]*)"`)
+	manifestTypes  = []string{
+		"application/vnd.oci.image.index.v1+json",
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+	}
+)
+
+type imageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseImageReference splits an image reference into its parts, docker hub defaults are applied.
+func parseImageReference(image string) imageReference {
+	ref := imageReference{}
+	normalized := normalizeImage(image)
+	if i := strings.Index(normalized, "@"); i >= 0 {
+		ref.Digest = normalized[i+1:]
+		normalized = normalized[:i]
+	}
+	parts := strings.SplitN(normalized, "/", 2)
+	ref.Registry, ref.Repository = parts[0], parts[1]
+	if i := strings.LastIndex(ref.Repository, ":"); i >= 0 {
+		ref.Tag = ref.Repository[i+1:]
+		ref.Repository = ref.Repository[:i]
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	if ref.Registry == "docker.io" {
+		ref.Registry = dockerHubRegistry
+	}
+	return ref
+}
+
+// registryCredentials are used to authenticate against image registries.
+type registryCredentials struct {
+	Username string
+	Password string
+	// Client replaces registryClient, e.g. to apply the TLS settings of a repository
+	Client *http.Client
+}
+
+func (c registryCredentials) client() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return registryClient
+}
+
+// resolveDigest asks the registry for the digest of the manifest the tag of image is pointing to.
+func resolveDigest(ctx context.Context, image string, credentials registryCredentials) (string, error) {
+	ref := parseImageReference(image)
+	if ref.Digest != "" {
+		return ref.Digest, nil
+	}
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repository, ref.Tag)
+
+	response, err := registryRequest(ctx, http.MethodHead, manifestURL, ref, credentials)
+	if err != nil {
+		return "", err
+	}
+	_ = response.Body.Close()
+	if digest := response.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// not all registries return the digest for HEAD requests
+	response, err = registryRequest(ctx, http.MethodGet, manifestURL, ref, credentials)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if digest := response.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, response.Body)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), nil
+}
+
+// registryRequest sends a request to the registry v2 API and handles basic and token authentication.
+// Temporary failures are retried.
+func registryRequest(ctx context.Context, method, requestURL string, ref imageReference, credentials registryCredentials) (*http.Response, error) {
+	var response *http.Response
+	err := retry(ctx, func() error {
+		var err error
+		response, err = authenticatedRegistryRequest(ctx, method, requestURL, ref, credentials)
+		return err
+	})
+	return response, err
+}
+
+func authenticatedRegistryRequest(ctx context.Context, method, requestURL string, ref imageReference, credentials registryCredentials) (*http.Response, error) {
+	response, err := sendRegistryRequest(ctx, method, requestURL, "", credentials)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusUnauthorized {
+		challenge := response.Header.Get("WWW-Authenticate")
+		_ = response.Body.Close()
+		authorization, err := authorize(ctx, challenge, ref, credentials)
+		if err != nil {
+			return nil, err
+		}
+		response, err = sendRegistryRequest(ctx, method, requestURL, authorization, credentials)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if response.StatusCode != http.StatusOK {
+		_ = response.Body.Close()
+		return nil, &httpStatusError{URL: requestURL, StatusCode: response.StatusCode}
+	}
+	return response, nil
+}
+
+// registryContent reads a manifest or blob from the registry.
+func registryContent(ctx context.Context, requestURL string, ref imageReference, credentials registryCredentials) ([]byte, error) {
+	response, err := registryRequest(ctx, http.MethodGet, requestURL, ref, credentials)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+	return ioutil.ReadAll(response.Body)
+}
+
+func sendRegistryRequest(ctx context.Context, method, requestURL, authorization string, credentials registryCredentials) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+	switch {
+	case authorization != "":
+		request.Header.Set("Authorization", authorization)
+	case credentials.Username != "":
+		request.SetBasicAuth(credentials.Username, credentials.Password)
+	}
+	return credentials.client().Do(request)
+}
+
+// authorize answers the challenge of the registry with the Authorization header to use.
+func authorize(ctx context.Context, challenge string, ref imageReference, credentials registryCredentials) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return "", fmt.Errorf("authentication required by registry %s", ref.Registry)
+	}
+	parameters := map[string]string{}
+	for _, match := range authParameter.FindAllStringSubmatch(challenge, -1) {
+		parameters[match[1]] = match[2]
+	}
+	tokenURL, err := url.Parse(parameters["realm"])
+	if err != nil || parameters["realm"] == "" {
+		return "", fmt.Errorf("invalid authentication challenge of registry %s: %s", ref.Registry, challenge)
+	}
+	// the token service may be located on another host, like auth.docker.io for docker hub, credentials are only
+	// sent encrypted
+	if credentials.Username != "" && tokenURL.Scheme != "https" {
+		return "", fmt.Errorf("registry %s requests credentials for the insecure token service %s", ref.Registry, tokenURL.Redacted())
+	}
+	query := tokenURL.Query()
+	if parameters["service"] != "" {
+		query.Set("service", parameters["service"])
+	}
+	scope := parameters["scope"]
+	// a login does not access a repository
+	if scope == "" && ref.Repository != "" {
+		scope = fmt.Sprintf("repository:%s:pull", ref.Repository)
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if credentials.Username != "" {
+		request.SetBasicAuth(credentials.Username, credentials.Password)
+	}
+	response, err := credentials.client().Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusOK {
+		return "", &httpStatusError{URL: tokenURL.String(), StatusCode: response.StatusCode}
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return "", fmt.Errorf("invalid token response of registry %s: %v", ref.Registry, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+type httpStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("request to %s failed: %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
@@ -0,0 +1,89 @@
+package helmt
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRegistry starts a registry stand-in, which requires a bearer token issued for user/pass.
+// Manifests are served for the given tag to digest mapping.
+func newTestRegistry(t *testing.T, digests map[string]string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			username, password, ok := r.BasicAuth()
+			if !ok || username != "user" || password != "pass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			assert.Equal(t, "registry.test", r.URL.Query().Get("service"))
+			_, _ = fmt.Fprint(w, `{"token": "secret-token"}`)
+		case strings.HasPrefix(r.URL.Path, "/v2/"):
+			if r.Header.Get("Authorization") != "Bearer secret-token" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry.test"`, server.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Path == "/v2/" {
+				return
+			}
+			digest, ok := digests[strings.TrimPrefix(r.URL.Path, "/v2/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", digest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	registryClient = server.Client()
+	return server
+}
+
+func Test_parseImageReference(t *testing.T) {
+	tests := []struct {
+		image    string
+		expected imageReference
+	}{
+		{image: "nginx", expected: imageReference{Registry: "registry-1.docker.io", Repository: "library/nginx", Tag: "latest"}},
+		{image: "jenkins/jenkins:lts", expected: imageReference{Registry: "registry-1.docker.io", Repository: "jenkins/jenkins", Tag: "lts"}},
+		{image: "localhost:5000/app:1.0", expected: imageReference{Registry: "localhost:5000", Repository: "app", Tag: "1.0"}},
+		{image: "quay.io/prometheus/node-exporter@sha256:abc", expected: imageReference{Registry: "quay.io", Repository: "prometheus/node-exporter", Digest: "sha256:abc"}},
+		{image: "quay.io/prometheus/node-exporter:v1.0.1@sha256:abc", expected: imageReference{Registry: "quay.io", Repository: "prometheus/node-exporter", Tag: "v1.0.1", Digest: "sha256:abc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			assert.Equal(t, tt.expected, parseImageReference(tt.image))
+		})
+	}
+}
+
+func Test_resolveDigest(t *testing.T) {
+	server := newTestRegistry(t, map[string]string{"team/app/manifests/1.0": "sha256:1111"})
+	defer server.Close()
+	registry := strings.TrimPrefix(server.URL, "https://")
+
+	digest, err := resolveDigest(context.Background(), registry+"/team/app:1.0", registryCredentials{Username: "user", Password: "pass"})
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:1111", digest)
+
+	_, err = resolveDigest(context.Background(), registry+"/team/app:2.0", registryCredentials{Username: "user", Password: "pass"})
+	assert.EqualError(t, err, fmt.Sprintf("request to %s/v2/team/app/manifests/2.0 failed: 404 Not Found", server.URL))
+
+	_, err = resolveDigest(context.Background(), registry+"/team/app:1.0", registryCredentials{Username: "user", Password: "wrong"})
+	assert.Error(t, err)
+}
+
+func Test_authorizeInsecureRealm(t *testing.T) {
+	_, err := authorize(context.Background(), `Bearer realm="http://auth.example.com/token",service="registry.test"`, imageReference{Registry: "registry.example.com", Repository: "team/app"}, registryCredentials{Username: "user", Password: "pass"})
+	assert.EqualError(t, err, "registry registry.example.com requests credentials for the insecure token service http://auth.example.com/token")
+}
@@ -0,0 +1,209 @@
+package helmt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/afero"
+)
+
+// dockerConfig is the format of ~/.docker/config.json, which is also used by helm for its registry config.
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths,omitempty"`
+	CredHelpers map[string]string     `json:"credHelpers,omitempty"`
+	CredsStore  string                `json:"credsStore,omitempty"`
+}
+
+type dockerAuth struct {
+	Auth     string `json:"auth,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// HelmRegistryConfigFile returns the location of the registry config of helm.
+func HelmRegistryConfigFile() string {
+	if file := os.Getenv("HELM_REGISTRY_CONFIG"); file != "" {
+		return file
+	}
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, _ := homedir.Dir()
+		switch runtime.GOOS {
+		case "darwin":
+			configHome = filepath.Join(home, "Library", "Preferences")
+		case "windows":
+			configHome = os.Getenv("APPDATA")
+		default:
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	return filepath.Join(configHome, "helm", "registry", "config.json")
+}
+
+func dockerConfigFile() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, _ := homedir.Dir()
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+func readDockerConfig(file string) (*dockerConfig, error) {
+	config := &dockerConfig{}
+	content, err := afero.ReadFile(fs, file)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry config %s: %v", file, err)
+	}
+	return config, nil
+}
+
+// registryHost normalizes the keys of a docker config like https://index.docker.io/v1/ to the host name.
+func registryHost(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	return strings.SplitN(server, "/", 2)[0]
+}
+
+// dockerHubConfigKey is the key the docker CLI stores the credentials of Docker Hub with.
+const dockerHubConfigKey = "https://index.docker.io/v1/"
+
+// configRegistryHost normalizes a registry or a key of a docker config to the host name. Like the docker CLI, the
+// hosts of Docker Hub are mapped to index.docker.io.
+func configRegistryHost(server string) string {
+	host := strings.ToLower(registryHost(server))
+	switch host {
+	case "docker.io", dockerHubRegistry:
+		return dockerHubIndex
+	}
+	return host
+}
+
+// matchingServers returns the keys of a docker config referring to registry. A key equal to registry comes first,
+// for Docker Hub the key of the docker CLI, followed by the other keys of the same host in sorted order, so that the
+// credentials do not depend on the order of the map.
+func matchingServers(servers []string, registry string) []string {
+	host := configRegistryHost(registry)
+	preferred := registry
+	if host == dockerHubIndex {
+		preferred = dockerHubConfigKey
+	}
+	var exact, normalized []string
+	for _, server := range servers {
+		switch {
+		case server == preferred:
+			exact = append(exact, server)
+		case configRegistryHost(server) == host:
+			normalized = append(normalized, server)
+		}
+	}
+	sort.Strings(normalized)
+	return append(exact, normalized...)
+}
+
+// credentialsFromRegistryConfigs looks up the credentials of registry in the registry config of helm and the
+// docker config. Credential helpers configured in these files are used as well.
+func credentialsFromRegistryConfigs(registry string) (string, string, error) {
+	for _, file := range []string{HelmRegistryConfigFile(), dockerConfigFile()} {
+		config, err := readDockerConfig(file)
+		if err != nil {
+			return "", "", err
+		}
+		helpers := make([]string, 0, len(config.CredHelpers))
+		for server := range config.CredHelpers {
+			helpers = append(helpers, server)
+		}
+		if servers := matchingServers(helpers, registry); len(servers) > 0 {
+			return credentialsFromHelper(config.CredHelpers[servers[0]], registry)
+		}
+		auths := make([]string, 0, len(config.Auths))
+		for server := range config.Auths {
+			auths = append(auths, server)
+		}
+		for _, server := range matchingServers(auths, registry) {
+			auth := config.Auths[server]
+			username, password := auth.Username, auth.Password
+			if auth.Auth != "" {
+				decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+				if err != nil {
+					return "", "", fmt.Errorf("invalid auth of %s in %s: %v", server, file, err)
+				}
+				parts := strings.SplitN(string(decoded), ":", 2)
+				if len(parts) != 2 {
+					return "", "", fmt.Errorf("invalid auth of %s in %s", server, file)
+				}
+				username, password = parts[0], parts[1]
+			}
+			if password != "" {
+				redactions.add(password)
+				return username, password, nil
+			}
+		}
+		if config.CredsStore != "" {
+			username, password, err := credentialsFromHelper(config.CredsStore, registry)
+			if err != nil || password != "" {
+				return username, password, err
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// Login verifies the credentials against registry and stores them in configFile using the docker config format.
+// Other content of configFile is kept.
+func Login(ctx context.Context, registry, username, password, configFile string) error {
+	if username == "" || password == "" {
+		return errors.New("username and password are required")
+	}
+	redactions.add(password)
+	host := registryHost(strings.TrimPrefix(registry, "oci://"))
+	credentials := registryCredentials{Username: username, Password: password}
+	response, err := registryRequest(ctx, http.MethodGet, fmt.Sprintf("https://%s/v2/", parseImageReference(host+"/login").Registry), imageReference{Registry: host}, credentials)
+	if err != nil {
+		return fmt.Errorf("login to %s failed: %v", host, err)
+	}
+	_ = response.Body.Close()
+
+	config := map[string]interface{}{}
+	content, err := afero.ReadFile(fs, configFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(content) > 0 {
+		err = json.Unmarshal(content, &config)
+		if err != nil {
+			return fmt.Errorf("invalid registry config %s: %v", configFile, err)
+		}
+	}
+	auths, _ := config["auths"].(map[string]interface{})
+	if auths == nil {
+		auths = map[string]interface{}{}
+	}
+	auths[host] = dockerAuth{Auth: base64.StdEncoding.EncodeToString([]byte(username + ":" + password))}
+	config["auths"] = auths
+
+	content, err = json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = fs.MkdirAll(filepath.Dir(configFile), 0700)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, configFile, append(content, '\n'), 0600)
+}
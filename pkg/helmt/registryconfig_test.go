@@ -0,0 +1,121 @@
+package helmt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setEnv(t *testing.T, key, value string) func() {
+	previous, set := os.LookupEnv(key)
+	require.NoError(t, os.Setenv(key, value))
+	return func() {
+		if set {
+			_ = os.Setenv(key, previous)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	}
+}
+
+func Test_HelmRegistryConfigFile(t *testing.T) {
+	defer setEnv(t, "HELM_REGISTRY_CONFIG", "")()
+	defer setEnv(t, "XDG_CONFIG_HOME", "/xdg")()
+	assert.Equal(t, "/xdg/helm/registry/config.json", HelmRegistryConfigFile())
+
+	defer setEnv(t, "HELM_REGISTRY_CONFIG", "/etc/helm/registry.json")()
+	assert.Equal(t, "/etc/helm/registry.json", HelmRegistryConfigFile())
+}
+
+func Test_credentialsFromRegistryConfigs(t *testing.T) {
+	fs = afero.NewOsFs()
+	defer useTestCredentialHelper(t)()
+	defer setEnv(t, "HELM_REGISTRY_CONFIG", "testdata/registry/helm-config.json")()
+	defer setEnv(t, "DOCKER_CONFIG", "testdata/registry/docker")()
+
+	tests := []struct {
+		registry     string
+		wantUsername string
+		wantPassword string
+	}{
+		{registry: "helm.example.com", wantUsername: "helm-user", wantPassword: "helm-pass"},
+		{registry: "shared.example.com", wantUsername: "helm-shared", wantPassword: "helm-shared-pass"},
+		{registry: "docker.example.com", wantUsername: "docker-user", wantPassword: "docker-pass"},
+		{registry: "vault.example.com", wantUsername: "vault-user", wantPassword: "vault-secret"},
+		{registry: "exact.example.com", wantUsername: "exact-user", wantPassword: "exact-pass"},
+		{registry: "index.docker.io", wantUsername: "hub-user", wantPassword: "hub-pass"},
+		{registry: "registry-1.docker.io", wantUsername: "hub-user", wantPassword: "hub-pass"},
+		{registry: "docker.io", wantUsername: "hub-user", wantPassword: "hub-pass"},
+		{registry: "unknown.example.com"},
+		{registry: "empty.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.registry, func(t *testing.T) {
+			username, password, err := credentialsFromRegistryConfigs(tt.registry)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantUsername, username)
+			assert.Equal(t, tt.wantPassword, password)
+		})
+	}
+
+	repository, err := repositoryConfig("oci://helm.example.com/charts", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, Repository{Username: "helm-user", Password: "helm-pass"}, repository)
+	repository, err = repositoryConfig("https://helm.example.com/charts", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, Repository{}, repository)
+}
+
+func Test_matchingServers(t *testing.T) {
+	servers := []string{"registry-1.docker.io", "docker.io", "https://index.docker.io/v1/", "index.docker.io", "ghcr.io"}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, []string{"https://index.docker.io/v1/", "docker.io", "index.docker.io", "registry-1.docker.io"}, matchingServers(servers, "registry-1.docker.io"))
+	}
+	assert.Equal(t, []string{"ghcr.io"}, matchingServers(servers, "GHCR.io"))
+	assert.Empty(t, matchingServers(servers, "quay.io"))
+}
+
+func TestLogin(t *testing.T) {
+	fs = afero.NewOsFs()
+	server := newTestRegistry(t, nil)
+	defer server.Close()
+	registry := strings.TrimPrefix(server.URL, "https://")
+
+	dir, err := ioutil.TempDir("", "helmt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "registry", "config.json")
+	require.NoError(t, os.MkdirAll(filepath.Dir(configFile), 0700))
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(`{"auths":{"other.example.com":{"auth":"b3RoZXI6b3RoZXI="}},"credsStore":"desktop"}`), 0600))
+
+	err = Login(context.Background(), "oci://"+registry, "user", "wrong", configFile)
+	assert.EqualError(t, err, fmt.Sprintf("login to %s failed: request to %s/token?service=registry.test failed: 401 Unauthorized", registry, server.URL))
+
+	err = Login(context.Background(), "oci://"+registry, "user", "pass", configFile)
+	require.NoError(t, err)
+	content, err := ioutil.ReadFile(configFile)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(`{
+	"auths": {
+		"%s": {
+			"auth": "dXNlcjpwYXNz"
+		},
+		"other.example.com": {
+			"auth": "b3RoZXI6b3RoZXI="
+		}
+	},
+	"credsStore": "desktop"
+}
+`, registry), string(content))
+	info, err := os.Stat(configFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
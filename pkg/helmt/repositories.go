@@ -0,0 +1,117 @@
+package helmt
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+const repositoriesKey = "repositories"
+
+// Repository holds the credentials and TLS settings of a chart repository, it is configured in the helmt config file
+// keyed by a prefix of the repository URL.
+type Repository struct {
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// PasswordEnv names an environment variable containing the password
+	PasswordEnv string `mapstructure:"passwordEnv"`
+	// CAFile, CertFile and KeyFile are resolved against the directory of the config file defining them if relative
+	CAFile   string `mapstructure:"caFile"`
+	CertFile string `mapstructure:"certFile"`
+	KeyFile  string `mapstructure:"keyFile"`
+	// InsecureSkipTLSVerify disables the verification of the server certificate
+	InsecureSkipTLSVerify bool `mapstructure:"insecureSkipTLSVerify"`
+	// PassCredentials passes the credentials to all domains, e.g. if the charts are hosted elsewhere than the index
+	PassCredentials bool `mapstructure:"passCredentials"`
+	// CredentialHelper names a docker credential helper which provides username and password,
+	// it overwrites the global credentialHelper
+	CredentialHelper string `mapstructure:"credentialHelper"`
+}
+
+// repositoryConfig returns the settings of the configured repository with the longest prefix of url.
+// username and password given as flags take precedence, a credential helper is only asked if no password is known.
+func repositoryConfig(url, username, password string) (Repository, error) {
+	repositories := map[string]Repository{}
+	err := viper.UnmarshalKey(repositoriesKey, &repositories)
+	if err != nil {
+		return Repository{}, fmt.Errorf("invalid repositories in config: %v", err)
+	}
+
+	repository := Repository{}
+	longest := -1
+	// viper keys are case insensitive
+	lowerURL := strings.ToLower(url)
+	for prefix, candidate := range repositories {
+		if hasURLPrefix(lowerURL, strings.ToLower(prefix)) && len(prefix) > longest {
+			repository = candidate
+			longest = len(prefix)
+		}
+	}
+
+	if repository.Password == "" && repository.PasswordEnv != "" {
+		repository.Password = os.Getenv(repository.PasswordEnv)
+		if repository.Password == "" {
+			return Repository{}, fmt.Errorf("environment variable %s with the password for %s is not set", repository.PasswordEnv, url)
+		}
+	}
+	repository.PasswordEnv = ""
+
+	if username != "" {
+		repository.Username = username
+	}
+	if password != "" {
+		repository.Password = password
+	}
+
+	helper := firstNonEmpty(repository.CredentialHelper, viper.GetString(credentialHelperKey))
+	repository.CredentialHelper = ""
+	if repository.Password == "" && helper != "" {
+		helperUsername, helperPassword, err := credentialsFromHelper(helper, credentialServer(url))
+		if err != nil {
+			return Repository{}, err
+		}
+		if repository.Username == "" {
+			repository.Username = helperUsername
+		}
+		repository.Password = helperPassword
+	}
+	if repository.Password == "" && strings.HasPrefix(url, "oci://") {
+		registryUsername, registryPassword, err := credentialsFromRegistryConfigs(credentialServer(url))
+		if err != nil {
+			return Repository{}, err
+		}
+		if repository.Username == "" {
+			repository.Username = registryUsername
+		}
+		repository.Password = registryPassword
+	}
+	redactions.add(repository.Password)
+	return repository, nil
+}
+
+// hasURLPrefix reports whether prefix matches url up to its end or a path separator, so that
+// https://charts.example.com does not match https://charts.example.com.evil.net.
+func hasURLPrefix(url, prefix string) bool {
+	if !strings.HasPrefix(url, prefix) {
+		return false
+	}
+	return len(url) == len(prefix) || strings.HasSuffix(prefix, "/") || url[len(prefix)] == '/'
+}
+
+// applyChartTLS overwrites the TLS settings of the repository with the ones of the chart.
+func applyChartTLS(repository Repository, chart *HelmChart) Repository {
+	if chart.CAFile != "" {
+		repository.CAFile = chart.CAFile
+	}
+	if chart.CertFile != "" {
+		repository.CertFile = chart.CertFile
+	}
+	if chart.KeyFile != "" {
+		repository.KeyFile = chart.KeyFile
+	}
+	repository.InsecureSkipTLSVerify = repository.InsecureSkipTLSVerify || chart.InsecureSkipTLSVerify
+	repository.PassCredentials = repository.PassCredentials || chart.PassCredentials
+	return repository
+}
@@ -0,0 +1,132 @@
+package helmt
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_repositoryConfig(t *testing.T) {
+	require.NoError(t, MergeConfigFile("testdata/helmt-config.yaml"))
+	defer viper.Reset()
+	require.NoError(t, os.Setenv("HELMT_TEST_INTERNAL_PASSWORD", "s3cr3t"))
+	defer os.Unsetenv("HELMT_TEST_INTERNAL_PASSWORD")
+
+	type args struct {
+		url      string
+		username string
+		password string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		expected Repository
+	}{
+		{
+			name:     "no matching repository",
+			args:     args{url: "https://charts.bitnami.com/bitnami"},
+			expected: Repository{},
+		},
+		{
+			name:     "flags without matching repository",
+			args:     args{url: "https://charts.bitnami.com/bitnami", username: "user", password: "pass"},
+			expected: Repository{Username: "user", Password: "pass"},
+		},
+		{
+			name:     "prefix",
+			args:     args{url: "https://hub.example.com/chartrepo/library"},
+			expected: Repository{Username: "reader", Password: "public-read"},
+		},
+		{
+			name: "longest prefix with password from environment",
+			args: args{url: "https://hub.example.com/chartrepo/internal/tools"},
+			expected: Repository{
+				Username: "robot$internal",
+				Password: "s3cr3t",
+				CAFile:   "testdata/certs/internal-ca.pem",
+				CertFile: "/etc/helmt/client.pem",
+				KeyFile:  "/etc/helmt/client-key.pem",
+			},
+		},
+		{
+			name: "flags take precedence",
+			args: args{url: "https://hub.example.com/chartrepo/internal", password: "override"},
+			expected: Repository{
+				Username: "robot$internal",
+				Password: "override",
+				CAFile:   "testdata/certs/internal-ca.pem",
+				CertFile: "/etc/helmt/client.pem",
+				KeyFile:  "/etc/helmt/client-key.pem",
+			},
+		},
+		{
+			name:     "prefix ends within a path segment",
+			args:     args{url: "https://hub.example.com/chartrepo/internal-tools"},
+			expected: Repository{Username: "reader", Password: "public-read"},
+		},
+		{
+			name:     "prefix ends within the host",
+			args:     args{url: "https://charts.internal.example.com.evil.net/stable"},
+			expected: Repository{},
+		},
+		{
+			name:     "tls options",
+			args:     args{url: "https://charts.internal.example.com/stable"},
+			expected: Repository{InsecureSkipTLSVerify: true, PassCredentials: true},
+		},
+		{
+			name:     "case insensitive",
+			args:     args{url: "oci://registry.example.com/charts"},
+			expected: Repository{Username: "oci-user", Password: "oci-pass"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := repositoryConfig(tt.args.url, tt.args.username, tt.args.password)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+
+	require.NoError(t, os.Unsetenv("HELMT_TEST_INTERNAL_PASSWORD"))
+	_, err := repositoryConfig("https://hub.example.com/chartrepo/internal", "", "")
+	assert.EqualError(t, err, "environment variable HELMT_TEST_INTERNAL_PASSWORD with the password for https://hub.example.com/chartrepo/internal is not set")
+}
+
+func Test_hasURLPrefix(t *testing.T) {
+	tests := []struct {
+		url    string
+		prefix string
+		want   bool
+	}{
+		{url: "https://charts.example.com", prefix: "https://charts.example.com", want: true},
+		{url: "https://charts.example.com/stable", prefix: "https://charts.example.com", want: true},
+		{url: "https://charts.example.com/stable", prefix: "https://charts.example.com/", want: true},
+		{url: "https://charts.example.com/stable", prefix: "https://charts.example.com/st"},
+		{url: "https://charts.example.com.evil.net", prefix: "https://charts.example.com"},
+		{url: "https://charts.example.com", prefix: "https://charts.example.com/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url+" "+tt.prefix, func(t *testing.T) {
+			assert.Equal(t, tt.want, hasURLPrefix(tt.url, tt.prefix))
+		})
+	}
+}
+
+func Test_applyChartTLS(t *testing.T) {
+	repository := Repository{Username: "user", CAFile: "ca.pem", CertFile: "client.pem", KeyFile: "client-key.pem", PassCredentials: true}
+	chart := &HelmChart{CAFile: "other-ca.pem", InsecureSkipTLSVerify: true}
+
+	actual := applyChartTLS(repository, chart)
+	assert.Equal(t, Repository{
+		Username:              "user",
+		CAFile:                "other-ca.pem",
+		CertFile:              "client.pem",
+		KeyFile:               "client-key.pem",
+		InsecureSkipTLSVerify: true,
+		PassCredentials:       true,
+	}, actual)
+}
@@ -0,0 +1,86 @@
+package helmt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/viper"
+)
+
+const (
+	FetchTimeoutFlag    = "fetch-timeout"
+	TemplateTimeoutFlag = "template-timeout"
+	RetriesFlag         = "retries"
+)
+
+// retryBackoff is the delay before the first retry, it doubles with every further retry.
+var retryBackoff = time.Second
+
+// withTimeout runs the phase with the timeout configured by flag, a timeout of 0 disables it.
+func withTimeout(ctx context.Context, phase, flag string, run func(ctx context.Context) error) error {
+	timeout := viper.GetDuration(flag)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := run(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s timed out after %v: %v", phase, timeout, err)
+	}
+	return err
+}
+
+// retry calls request until it succeeds, fails with an error which is not worth retrying or the configured number of
+// retries is used up.
+func retry(ctx context.Context, request func() error) error {
+	delay := retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := request()
+		if err == nil || attempt >= viper.GetInt(RetriesFlag) || !isRetryable(ctx, err) {
+			return err
+		}
+		color.Yellow("Warning: %v, retrying in %v", RedactError(err), delay)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// isRetryable returns true for errors which are likely to be temporary, like timeouts, dropped connections and
+// server errors. Client errors like 404 Not Found or 401 Unauthorized are not retried, neither are refused connections
+// and unknown hosts, which are rather misconfigurations.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var statusError *httpStatusError
+	if errors.As(err, &statusError) {
+		switch statusError.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		return true
+	}
+	var dnsError *net.DNSError
+	if errors.As(err, &dnsError) {
+		return dnsError.IsTemporary
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,162 @@
+package helmt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_retry(t *testing.T) {
+	tests := []struct {
+		name         string
+		statusCodes  []int
+		retries      int
+		wantRequests int
+		wantErr      bool
+	}{
+		{name: "success", statusCodes: []int{http.StatusOK}, retries: 2, wantRequests: 1},
+		{name: "retried", statusCodes: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, retries: 2, wantRequests: 3},
+		{name: "retries used up", statusCodes: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, retries: 2, wantRequests: 3, wantErr: true},
+		{name: "no retries", statusCodes: []int{http.StatusTooManyRequests}, retries: 0, wantRequests: 1, wantErr: true},
+		{name: "not found", statusCodes: []int{http.StatusNotFound, http.StatusOK}, retries: 2, wantRequests: 1, wantErr: true},
+		{name: "unauthorized", statusCodes: []int{http.StatusUnauthorized, http.StatusOK}, retries: 2, wantRequests: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set(RetriesFlag, tt.retries)
+			defer viper.Reset()
+			retryBackoff = time.Millisecond
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statusCodes[requests])
+				requests++
+			}))
+			defer server.Close()
+
+			_, err := repositoryGet(context.Background(), server.Client(), server.URL+"/index.yaml", Repository{}, false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("repositoryGet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.wantRequests, requests)
+		})
+	}
+}
+
+func Test_retryCanceled(t *testing.T) {
+	viper.Set(RetriesFlag, 3)
+	defer viper.Reset()
+	retryBackoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	requests := 0
+	err := retry(ctx, func() error {
+		requests++
+		cancel()
+		return &httpStatusError{URL: "https://charts.example.com", StatusCode: http.StatusBadGateway}
+	})
+	assert.EqualError(t, err, "request to https://charts.example.com failed: 502 Bad Gateway")
+	assert.Equal(t, 1, requests)
+}
+
+func Test_retryRedactsWarning(t *testing.T) {
+	viper.Set(RetriesFlag, 1)
+	defer viper.Reset()
+	retryBackoff = time.Millisecond
+	previous := redactions
+	redactions = &redactor{}
+	defer func() { redactions = previous }()
+	redactions.add("s3cr3t-token")
+	previousOutput := color.Output
+	output := &bytes.Buffer{}
+	color.Output = output
+	defer func() { color.Output = previousOutput }()
+
+	_ = retry(context.Background(), func() error {
+		return &httpStatusError{URL: "https://charts.example.com/index.yaml?token=s3cr3t-token", StatusCode: http.StatusBadGateway}
+	})
+	assert.Contains(t, output.String(), "https://charts.example.com/index.yaml?token=*****")
+	assert.NotContains(t, output.String(), "s3cr3t-token")
+}
+
+func Test_withTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout string
+		wantErr string
+	}{
+		{name: "timeout", timeout: "10ms", wantErr: "fetch timed out after 10ms: context deadline exceeded"},
+		{name: "disabled", timeout: "0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set(FetchTimeoutFlag, tt.timeout)
+			defer viper.Reset()
+			err := withTimeout(context.Background(), "fetch", FetchTimeoutFlag, func(ctx context.Context) error {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(50 * time.Millisecond):
+					return nil
+				}
+			})
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_isRetryable(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{name: "server error", err: &httpStatusError{StatusCode: http.StatusInternalServerError}, want: true},
+		{name: "gateway timeout", err: &httpStatusError{StatusCode: http.StatusGatewayTimeout}, want: true},
+		{name: "too many requests", err: &httpStatusError{StatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "forbidden", err: &httpStatusError{StatusCode: http.StatusForbidden}},
+		{name: "not found", err: fmt.Errorf("failed: %w", &httpStatusError{StatusCode: http.StatusNotFound})},
+		{name: "timeout", err: fmt.Errorf("failed: %w", timeoutError{}), want: true},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}},
+		{name: "connection reset", err: fmt.Errorf("failed: %w", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), want: true},
+		{name: "broken pipe", err: &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}, want: true},
+		{name: "unknown host", err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "charts.example.com", IsNotFound: true}}},
+		{name: "temporary DNS failure", err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "server misbehaving", Name: "charts.example.com", IsTemporary: true}}, want: true},
+		{name: "connection closed", err: io.ErrUnexpectedEOF, want: true},
+		{name: "canceled", ctx: canceled, err: &httpStatusError{StatusCode: http.StatusBadGateway}},
+		{name: "other", err: errors.New("invalid manifest")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			assert.Equal(t, tt.want, isRetryable(ctx, tt.err))
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package helmt
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// jsonSchema is a parsed json schema together with the document it belongs to, which is needed to resolve references.
+type jsonSchema struct {
+	definition map[string]interface{}
+	document   *schemaDocument
+}
+
+type schemaDocument struct {
+	root map[string]interface{}
+	file string
+}
+
+// schemaLoader caches schema documents referenced by $ref.
+type schemaLoader struct {
+	documents map[string]*schemaDocument
+}
+
+func newSchemaLoader() *schemaLoader {
+	return &schemaLoader{documents: map[string]*schemaDocument{}}
+}
+
+func (l *schemaLoader) load(file string) (*jsonSchema, error) {
+	document, ok := l.documents[file]
+	if !ok {
+		content, err := afero.ReadFile(fs, file)
+		if err != nil {
+			return nil, err
+		}
+		root := map[string]interface{}{}
+		err = json.Unmarshal(content, &root)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse schema %s: %v", file, err)
+		}
+		document = &schemaDocument{root: root, file: file}
+		l.documents[file] = document
+	}
+	return &jsonSchema{definition: document.root, document: document}, nil
+}
+
+// resolve follows a reference like "#/definitions/x" or "_definitions.json#/definitions/x".
+func (l *schemaLoader) resolve(ref string, current *schemaDocument) (*jsonSchema, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	document := current
+	if parts[0] != "" {
+		if current.file == "" {
+			return nil, fmt.Errorf("cannot resolve reference %s", ref)
+		}
+		loaded, err := l.load(filepath.Join(filepath.Dir(current.file), parts[0]))
+		if err != nil {
+			return nil, err
+		}
+		document = loaded.document
+	}
+	var target interface{} = document.root
+	if len(parts) == 2 {
+		for _, segment := range strings.Split(strings.TrimPrefix(parts[1], "/"), "/") {
+			if segment == "" {
+				continue
+			}
+			segment = strings.ReplaceAll(strings.ReplaceAll(segment, "~1", "/"), "~0", "~")
+			m, ok := target.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("cannot resolve reference %s", ref)
+			}
+			target = m[segment]
+		}
+	}
+	definition, ok := target.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot resolve reference %s", ref)
+	}
+	return &jsonSchema{definition: definition, document: document}, nil
+}
+
+// validate checks value against the schema and returns all violations prefixed by their field path.
+// It supports the subset of json schema and OpenAPI v3 used by kubernetes and CRD schemas.
+func (l *schemaLoader) validate(schema *jsonSchema, value interface{}, path string) []string {
+	definition := schema.definition
+	if ref, ok := definition["$ref"].(string); ok {
+		resolved, err := l.resolve(ref, schema.document)
+		if err != nil {
+			return []string{fmt.Sprintf("%s: %v", fieldPath(path), err)}
+		}
+		return l.validate(resolved, value, path)
+	}
+	sub := func(d interface{}) *jsonSchema {
+		m, _ := d.(map[string]interface{})
+		return &jsonSchema{definition: m, document: schema.document}
+	}
+
+	if value == nil {
+		if nullable, _ := definition["nullable"].(bool); nullable || allowsType(definition, "null") {
+			return nil
+		}
+	}
+	if intOrString, _ := definition["x-kubernetes-int-or-string"].(bool); intOrString {
+		if _, ok := value.(string); ok || isInteger(value) {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: expected integer or string, got %s", fieldPath(path), typeName(value))}
+	}
+
+	var violations []string
+	if types := schemaTypes(definition); len(types) > 0 {
+		matched := false
+		for _, t := range types {
+			if hasType(value, t) {
+				matched = true
+			}
+		}
+		if !matched {
+			return []string{fmt.Sprintf("%s: expected %s, got %s", fieldPath(path), strings.Join(types, " or "), typeName(value))}
+		}
+	}
+
+	if enum, ok := definition["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+			}
+		}
+		if !found {
+			violations = append(violations, fmt.Sprintf("%s: value %v is not one of %v", fieldPath(path), value, enum))
+		}
+	}
+	if pattern, ok := definition["pattern"].(string); ok {
+		if s, ok := value.(string); ok {
+			matched, err := regexp.MatchString(pattern, s)
+			if err == nil && !matched {
+				violations = append(violations, fmt.Sprintf("%s: value %q does not match %s", fieldPath(path), s, pattern))
+			}
+		}
+	}
+	if number, ok := toFloat(value); ok {
+		if minimum, ok := definition["minimum"].(float64); ok && number < minimum {
+			violations = append(violations, fmt.Sprintf("%s: value %v is less than %v", fieldPath(path), value, minimum))
+		}
+		if maximum, ok := definition["maximum"].(float64); ok && number > maximum {
+			violations = append(violations, fmt.Sprintf("%s: value %v is greater than %v", fieldPath(path), value, maximum))
+		}
+	}
+
+	if object, ok := value.(map[string]interface{}); ok {
+		violations = append(violations, l.validateObject(schema, object, path)...)
+	}
+	if array, ok := value.([]interface{}); ok {
+		if items, ok := definition["items"].(map[string]interface{}); ok {
+			for i, item := range array {
+				violations = append(violations, l.validate(sub(items), item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+
+	if allOf, ok := definition["allOf"].([]interface{}); ok {
+		for _, s := range allOf {
+			violations = append(violations, l.validate(sub(s), value, path)...)
+		}
+	}
+	for _, keyword := range []string{"oneOf", "anyOf"} {
+		alternatives, ok := definition[keyword].([]interface{})
+		if !ok {
+			continue
+		}
+		matches := 0
+		var first []string
+		for _, s := range alternatives {
+			result := l.validate(sub(s), value, path)
+			if len(result) == 0 {
+				matches++
+			} else if first == nil {
+				first = result
+			}
+		}
+		if matches == 0 {
+			violations = append(violations, first...)
+		} else if keyword == "oneOf" && matches > 1 {
+			violations = append(violations, fmt.Sprintf("%s: value matches more than one schema", fieldPath(path)))
+		}
+	}
+	return violations
+}
+
+func (l *schemaLoader) validateObject(schema *jsonSchema, object map[string]interface{}, path string) []string {
+	definition := schema.definition
+	var violations []string
+	if required, ok := definition["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, ok := object[name]; !ok {
+				violations = append(violations, fmt.Sprintf("%s: missing required field", fieldPath(join(path, name))))
+			}
+		}
+	}
+
+	properties, _ := definition["properties"].(map[string]interface{})
+	preserveUnknown, _ := definition["x-kubernetes-preserve-unknown-fields"].(bool)
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if property, ok := properties[key].(map[string]interface{}); ok {
+			violations = append(violations, l.validate(&jsonSchema{definition: property, document: schema.document}, object[key], join(path, key))...)
+			continue
+		}
+		switch additional := definition["additionalProperties"].(type) {
+		case bool:
+			if !additional && !preserveUnknown {
+				violations = append(violations, fmt.Sprintf("%s: unknown field", fieldPath(join(path, key))))
+			}
+		case map[string]interface{}:
+			violations = append(violations, l.validate(&jsonSchema{definition: additional, document: schema.document}, object[key], join(path, key))...)
+		}
+	}
+	return violations
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func fieldPath(path string) string {
+	if path == "" {
+		return "(root)"
+	}
+	return path
+}
+
+func schemaTypes(definition map[string]interface{}) []string {
+	switch t := definition["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var types []string
+		for _, e := range t {
+			if s, ok := e.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func allowsType(definition map[string]interface{}, name string) bool {
+	for _, t := range schemaTypes(definition) {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(value interface{}, name string) bool {
+	switch name {
+	case "null":
+		return value == nil
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "integer":
+		return isInteger(value)
+	case "number":
+		_, ok := toFloat(value)
+		return ok
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	}
+	return true
+}
+
+func isInteger(value interface{}) bool {
+	f, ok := toFloat(value)
+	return ok && f == math.Trunc(f)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	if isInteger(value) {
+		return "integer"
+	}
+	if _, ok := toFloat(value); ok {
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,210 @@
+package helmt
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/viper"
+)
+
+const (
+	secretScanKey = "secretScan"
+	// allowPlaintextAnnotation lists the keys or environment variables of a resource which may contain plaintext
+	// credentials, "true" allows all of them.
+	allowPlaintextAnnotation = "helmt.syncier.com/allow-plaintext"
+
+	minSecretLength  = 20
+	minSecretEntropy = 4.0
+)
+
+var (
+	credentialKeyPattern    = regexp.MustCompile(`(?i)(passw(or)?d|secret|token|api[-_]?key|credential|private[-_]?key|access[-_]?key)`)
+	credentialValuePatterns = []*regexp.Regexp{
+		regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`),
+		regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`),
+		regexp.MustCompile(`://[^/\s:@]+:[^/\s@]+@`),
+	}
+)
+
+// SecretScan configures the detection of plaintext credentials in the rendered manifests.
+// It can be set in the spec and in the config file, settings of the spec take precedence.
+type SecretScan struct {
+	// Enabled is a pointer, so that the spec can disable the scan enabled in the config file
+	Enabled *bool `yaml:"enabled" mapstructure:"enabled"`
+	// Mode defines whether findings fail the run or only print a warning, defaults to fail
+	Mode string `yaml:"mode" mapstructure:"mode" validate:"omitempty,oneof=fail warn"`
+}
+
+func mergeSecretScan(spec SecretScan) (SecretScan, error) {
+	global := SecretScan{}
+	err := viper.UnmarshalKey(secretScanKey, &global)
+	if err != nil {
+		return SecretScan{}, fmt.Errorf("invalid secretScan in config: %v", err)
+	}
+	merged := SecretScan{
+		Enabled: firstBool(spec.Enabled, global.Enabled),
+		Mode:    firstNonEmpty(spec.Mode, global.Mode, "fail"),
+	}
+	err = validate.Struct(merged)
+	if err != nil {
+		return SecretScan{}, fmt.Errorf("invalid secretScan: %v", err)
+	}
+	return merged, nil
+}
+
+// scanSecretsCommand looks for plaintext credentials in the manifests rendered into directory.
+// The values of all Secrets are registered for redaction, even if the scan is disabled.
+func scanSecretsCommand(directory string, spec SecretScan) error {
+	options, err := mergeSecretScan(spec)
+	if err != nil {
+		return err
+	}
+
+	var findings []string
+	err = walkManifests(directory, func(path string, documents [][]byte) error {
+		rel, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		for i, document := range documents {
+			manifest, err := parseManifest(document)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", path, err)
+			}
+			location := fmt.Sprintf("%s (document %d) %v/%v", rel, i+1, manifest["kind"], lookup(manifest, "metadata", "name"))
+			for _, message := range scanManifest(manifest) {
+				findings = append(findings, fmt.Sprintf("%s: %s", location, message))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !*options.Enabled || len(findings) == 0 {
+		return nil
+	}
+
+	if options.Mode == "warn" {
+		for _, finding := range findings {
+			color.Yellow("Warning: %s", finding)
+		}
+		return nil
+	}
+	return fmt.Errorf("plaintext secrets found:\n  %s", strings.Join(findings, "\n  "))
+}
+
+// scanManifest returns a message for every plaintext credential of manifest and registers the values for redaction.
+func scanManifest(manifest map[interface{}]interface{}) []string {
+	allowed := allowedPlaintextKeys(manifest)
+	var messages []string
+	switch manifest["kind"] {
+	case "Secret":
+		for _, field := range []string{"data", "stringData"} {
+			for _, key := range sortedKeys(manifest[field]) {
+				value := stringValue(lookup(manifest, field, key))
+				redactions.add(value)
+				if field == "data" {
+					if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+						redactions.add(string(decoded))
+					}
+				}
+				if value != "" && !allowed(key) {
+					messages = append(messages, fmt.Sprintf("%s.%s contains a literal value", field, key))
+				}
+			}
+		}
+	case "ConfigMap":
+		for _, key := range sortedKeys(manifest["data"]) {
+			value := stringValue(lookup(manifest, "data", key))
+			if reason := credentialReason(key, value); reason != "" && !allowed(key) {
+				redactions.add(value)
+				messages = append(messages, fmt.Sprintf("data.%s %s", key, reason))
+			}
+		}
+	}
+	_ = visitContainers(manifest, func(_ map[interface{}]interface{}, _ string, container map[interface{}]interface{}) error {
+		env, _ := container["env"].([]interface{})
+		for _, e := range env {
+			name, _ := lookup(e, "name").(string)
+			value, ok := lookup(e, "value").(string)
+			if !ok {
+				continue
+			}
+			if reason := credentialReason(name, value); reason != "" && !allowed(name) {
+				redactions.add(value)
+				messages = append(messages, fmt.Sprintf("env %s of container %v %s", name, container["name"], reason))
+			}
+		}
+		return nil
+	})
+	return messages
+}
+
+func allowedPlaintextKeys(manifest map[interface{}]interface{}) func(key string) bool {
+	annotation, _ := lookup(manifest, "metadata", "annotations", allowPlaintextAnnotation).(string)
+	keys := map[string]bool{}
+	for _, key := range strings.Split(annotation, ",") {
+		keys[strings.TrimSpace(key)] = true
+	}
+	return func(key string) bool {
+		return keys["true"] || keys[key]
+	}
+}
+
+// credentialReason explains why value looks like a credential or returns an empty string.
+func credentialReason(key, value string) string {
+	if strings.TrimSpace(value) == "" {
+		return ""
+	}
+	if credentialKeyPattern.MatchString(key) && !strings.ContainsAny(value, " \n") {
+		return "has a credential-like name"
+	}
+	for _, pattern := range credentialValuePatterns {
+		if pattern.MatchString(value) {
+			return "contains a credential-like value"
+		}
+	}
+	if len(value) >= minSecretLength && !strings.ContainsAny(value, " \n") && entropy(value) >= minSecretEntropy {
+		return "contains a high-entropy value"
+	}
+	return ""
+}
+
+// entropy returns the shannon entropy of value in bits per character.
+func entropy(value string) float64 {
+	counts := map[rune]int{}
+	for _, r := range value {
+		counts[r]++
+	}
+	length := float64(len([]rune(value)))
+	result := 0.0
+	for _, count := range counts {
+		p := float64(count) / length
+		result -= p * math.Log2(p)
+	}
+	return result
+}
+
+func stringValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func sortedKeys(value interface{}) []string {
+	m, _ := value.(map[interface{}]interface{})
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, fmt.Sprint(key))
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,213 @@
+package helmt
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+type Validation struct {
+	Enabled bool `yaml:"enabled"`
+	// KubeVersion selects the schemas of the given kubernetes version, e.g. 1.21.0
+	KubeVersion string `yaml:"kubeVersion"`
+	// SchemaDirs contain json schemas named like <kind>-<group>-<version>.json, either directly
+	// or in a subdirectory per kubernetes version like v1.21.0-standalone-strict, or <group>/<kind>_<version>.json for CRDs.
+	SchemaDirs []string `yaml:"schemaDirs"`
+}
+
+type schemaKey struct {
+	ApiVersion string
+	Kind       string
+}
+
+// schemaRegistry finds the schema of a resource in the schema directories or the CRDs of the rendered chart.
+type schemaRegistry struct {
+	loader  *schemaLoader
+	dirs    []string
+	crds    map[schemaKey]*jsonSchema
+	missing map[schemaKey]bool
+}
+
+// validateManifestsCommand validates every rendered document against its schema.
+// Resources without schema are reported as warning.
+func validateManifestsCommand(directory string, options Validation) error {
+	registry := &schemaRegistry{
+		loader:  newSchemaLoader(),
+		dirs:    schemaDirectories(options),
+		crds:    map[schemaKey]*jsonSchema{},
+		missing: map[schemaKey]bool{},
+	}
+
+	type document struct {
+		file     string
+		index    int
+		manifest map[string]interface{}
+	}
+	var documents []document
+	err := walkManifests(directory, func(path string, content [][]byte) error {
+		rel, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		for i, c := range content {
+			manifest, err := parseManifest(c)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %v", path, err)
+			}
+			converted, _ := toJSONValue(manifest).(map[string]interface{})
+			documents = append(documents, document{file: filepath.ToSlash(rel), index: i + 1, manifest: converted})
+			registry.addCRD(converted)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var violations []string
+	for _, d := range documents {
+		schema, err := registry.lookup(d.manifest)
+		if err != nil {
+			return err
+		}
+		if schema == nil {
+			continue
+		}
+		for _, violation := range registry.loader.validate(schema, d.manifest, "") {
+			violations = append(violations, fmt.Sprintf("%s (document %d): %s", d.file, d.index, violation))
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("invalid manifests:\n  %s", strings.Join(violations, "\n  "))
+	}
+	return nil
+}
+
+func schemaDirectories(options Validation) []string {
+	version := options.KubeVersion
+	if version != "" && !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	if strings.Count(version, ".") == 1 {
+		version += ".0"
+	}
+	var dirs []string
+	for _, dir := range options.SchemaDirs {
+		if version != "" {
+			for _, suffix := range []string{"-standalone-strict", "-standalone", ""} {
+				dirs = append(dirs, filepath.Join(dir, version+suffix))
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// addCRD registers the schemas of all versions defined by a CustomResourceDefinition.
+func (r *schemaRegistry) addCRD(manifest map[string]interface{}) {
+	if manifest["kind"] != "CustomResourceDefinition" {
+		return
+	}
+	group, _ := jsonLookup(manifest, "spec", "group").(string)
+	kind, _ := jsonLookup(manifest, "spec", "names", "kind").(string)
+	add := func(version string, schema interface{}) {
+		definition, ok := schema.(map[string]interface{})
+		if ok && version != "" {
+			r.crds[schemaKey{ApiVersion: group + "/" + version, Kind: kind}] = &jsonSchema{definition: definition, document: &schemaDocument{root: definition}}
+		}
+	}
+	// apiextensions.k8s.io/v1beta1
+	if version, ok := jsonLookup(manifest, "spec", "version").(string); ok {
+		add(version, jsonLookup(manifest, "spec", "validation", "openAPIV3Schema"))
+	}
+	versions, _ := jsonLookup(manifest, "spec", "versions").([]interface{})
+	for _, v := range versions {
+		name, _ := jsonLookup(v, "name").(string)
+		schema := jsonLookup(v, "schema", "openAPIV3Schema")
+		if schema == nil {
+			schema = jsonLookup(manifest, "spec", "validation", "openAPIV3Schema")
+		}
+		add(name, schema)
+	}
+}
+
+func (r *schemaRegistry) lookup(manifest map[string]interface{}) (*jsonSchema, error) {
+	apiVersion, _ := manifest["apiVersion"].(string)
+	kind, _ := manifest["kind"].(string)
+	key := schemaKey{ApiVersion: apiVersion, Kind: kind}
+	if apiVersion == "" || kind == "" {
+		return nil, nil
+	}
+	if schema, ok := r.crds[key]; ok {
+		return schema, nil
+	}
+
+	group, version := "", apiVersion
+	if i := strings.LastIndex(apiVersion, "/"); i >= 0 {
+		group, version = apiVersion[:i], apiVersion[i+1:]
+	}
+	kind = strings.ToLower(kind)
+	names := []string{fmt.Sprintf("%s-%s.json", kind, version)}
+	if group != "" {
+		names = []string{
+			fmt.Sprintf("%s-%s-%s.json", kind, strings.Split(group, ".")[0], version),
+			filepath.Join(group, fmt.Sprintf("%s_%s.json", kind, version)),
+		}
+	}
+	for _, dir := range r.dirs {
+		for _, name := range names {
+			file := filepath.Join(dir, name)
+			if _, err := fs.Stat(file); err != nil {
+				continue
+			}
+			return r.loader.load(file)
+		}
+	}
+
+	if !r.missing[key] {
+		r.missing[key] = true
+		color.Yellow("Warning: no schema found for %s %s, skipping validation", apiVersion, manifest["kind"])
+	}
+	return nil, nil
+}
+
+// toJSONValue converts the result of yaml.Unmarshal into the types produced by json.Unmarshal.
+func toJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, e := range v {
+			m[fmt.Sprint(key)] = toJSONValue(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = toJSONValue(e)
+		}
+		return a
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return value
+}
+
+func jsonLookup(value interface{}, path ...string) interface{} {
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
@@ -0,0 +1,67 @@
+package helmt
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_validateManifests(t *testing.T) {
+	fs = afero.NewOsFs()
+
+	err := validateManifestsCommand("testdata/validation", Validation{
+		Enabled:     true,
+		KubeVersion: "1.21",
+		SchemaDirs:  []string{"testdata/schemas", "testdata/schemas/extra"},
+	})
+
+	assert.EqualError(t, err, `invalid manifests:
+  templates/backup.yaml (document 1): spec.target: missing required field
+  templates/backup.yaml (document 2): spec.cron: value "every night" does not match ^\S+ \S+ \S+ \S+ \S+$
+  templates/deployment.yaml (document 1): spec.replicas: expected integer, got string
+  templates/deployment.yaml (document 1): spec.selectr: unknown field
+  templates/deployment.yaml (document 1): spec.template.spec.containers[0].imagePullPolicy: value Sometimes is not one of [Always IfNotPresent Never]
+  templates/deployment.yaml (document 1): spec.template.spec.containers[0].ports[0].containerPort: value 70000 is greater than 65535
+  templates/deployment.yaml (document 1): spec.template.spec.containers[1].name: missing required field`)
+}
+
+func Test_validateManifestsWithoutSchemas(t *testing.T) {
+	fs = afero.NewOsFs()
+
+	err := validateManifestsCommand("testdata/jenkins", Validation{Enabled: true, KubeVersion: "1.21.0"})
+	assert.NoError(t, err)
+}
+
+func Test_validateManifestsInMemory(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/rendered/templates/configmap.yaml", []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  replicas: 2
+`), os.ModePerm))
+	require.NoError(t, afero.WriteFile(fs, "/schemas/configmap-v1.json", []byte(`{
+  "type": "object",
+  "properties": {
+    "data": {"type": "object", "additionalProperties": {"type": "string"}}
+  }
+}`), os.ModePerm))
+
+	err := validateManifestsCommand("/rendered", Validation{Enabled: true, SchemaDirs: []string{"/schemas"}})
+	assert.EqualError(t, err, `invalid manifests:
+  templates/configmap.yaml (document 1): data.replicas: expected string, got integer`)
+}
+
+func Test_schemaDirectories(t *testing.T) {
+	assert.Equal(t, []string{
+		"schemas/v1.21.0-standalone-strict",
+		"schemas/v1.21.0-standalone",
+		"schemas/v1.21.0",
+		"schemas",
+	}, schemaDirectories(Validation{KubeVersion: "1.21", SchemaDirs: []string{"schemas"}}))
+	assert.Equal(t, []string{"schemas"}, schemaDirectories(Validation{SchemaDirs: []string{"schemas"}}))
+}
@@ -0,0 +1,371 @@
+package helmt
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/fatih/color"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	verifyKey = "verify"
+	// defaultKeyring is the default keyring of helm
+	defaultKeyring = "~/.gnupg/pubring.gpg"
+
+	verifyOff     = "off"
+	verifyWarn    = "warn"
+	verifyEnforce = "enforce"
+
+	verificationVerified = "verified"
+	verificationUnsigned = "unsigned"
+	verificationFailed   = "failed"
+
+	helmChartLayerType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	// cosignSignatureAnnotation holds the base64 encoded signature of a layer of a cosign signature manifest
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// Verification configures the verification of the provenance of the chart before it is rendered.
+// It can be set in the spec and in the config file, settings of the spec take precedence.
+type Verification struct {
+	// Mode is one of off, warn or enforce, defaults to off
+	Mode string `yaml:"mode" mapstructure:"mode" validate:"omitempty,oneof=off warn enforce"`
+	// Keyring is the PGP keyring used for charts of HTTP repositories, defaults to ~/.gnupg/pubring.gpg
+	Keyring string `yaml:"keyring" mapstructure:"keyring"`
+	// PublicKey is the PEM encoded public key the cosign signatures of OCI charts are verified with
+	PublicKey string `yaml:"publicKey" mapstructure:"publicKey"`
+}
+
+// verificationResult is recorded in the output metadata.
+type verificationResult struct {
+	Mode        string `yaml:"mode"`
+	Status      string `yaml:"status"`
+	Key         string `yaml:"key,omitempty"`
+	SignedBy    string `yaml:"signedBy,omitempty"`
+	Fingerprint string `yaml:"fingerprint,omitempty"`
+	Digest      string `yaml:"digest,omitempty"`
+	Message     string `yaml:"message,omitempty"`
+}
+
+func mergeVerification(spec Verification) (Verification, error) {
+	global := Verification{}
+	err := viper.UnmarshalKey(verifyKey, &global)
+	if err != nil {
+		return Verification{}, fmt.Errorf("invalid verify in config: %v", err)
+	}
+	merged := Verification{
+		Mode:      firstNonEmpty(spec.Mode, global.Mode, verifyOff),
+		Keyring:   firstNonEmpty(spec.Keyring, global.Keyring),
+		PublicKey: firstNonEmpty(spec.PublicKey, global.PublicKey),
+	}
+	err = validate.Struct(merged)
+	if err != nil {
+		return Verification{}, fmt.Errorf("invalid verify: %v", err)
+	}
+	return merged, nil
+}
+
+// verifyChartCommand verifies the provenance of the chart package fetched into tmpDir. Charts of HTTP repositories
+// are verified by the provenance file downloaded next to the package, OCI charts by a cosign signature.
+// In enforce mode an unsigned or tampered chart is an error, in warn mode only a warning is printed.
+func verifyChartCommand(ctx context.Context, tmpDir, chartFile string, chart *HelmChart, config Repository, options Verification) (*verificationResult, error) {
+	if options.Mode == verifyOff {
+		return nil, nil
+	}
+
+	var result *verificationResult
+	var err error
+	if strings.HasPrefix(chart.Repository, "oci://") {
+		result, err = verifyCosignSignature(ctx, filepath.Join(tmpDir, chartFile), chart, config, options.PublicKey)
+	} else {
+		result, err = verifyProvenance(filepath.Join(tmpDir, chartFile), options.Keyring)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Mode = options.Mode
+
+	if result.Status != verificationVerified {
+		if options.Mode == verifyEnforce {
+			return nil, fmt.Errorf("verification of chart %s %s failed: %s", chart.Chart, chart.Version, result.Message)
+		}
+		color.Yellow("Warning: verification of chart %s %s failed: %s", chart.Chart, chart.Version, result.Message)
+		return result, nil
+	}
+	color.Magenta("verified %s %s", chart.Chart, chart.Version)
+	return result, nil
+}
+
+// verifyProvenance checks the provenance file downloaded next to the chart package like helm verify does: the
+// provenance file has to be signed by a key of the PGP keyring and has to contain the digest of the chart package.
+func verifyProvenance(chartPackage, keyring string) (*verificationResult, error) {
+	if keyring == "" {
+		keyring = defaultKeyring
+	}
+	keyring, err := homedir.Expand(keyring)
+	if err != nil {
+		return nil, err
+	}
+	result := &verificationResult{Key: keyring}
+	exists, err := afero.Exists(fs, chartPackage+".prov")
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		result.Status = verificationUnsigned
+		result.Message = fmt.Sprintf("no provenance file found for %s", filepath.Base(chartPackage))
+		return result, nil
+	}
+
+	keys, err := readKeyring(keyring)
+	if err != nil {
+		return nil, err
+	}
+	provenance, err := afero.ReadFile(fs, chartPackage+".prov")
+	if err != nil {
+		return nil, err
+	}
+	content, err := afero.ReadFile(fs, chartPackage)
+	if err != nil {
+		return nil, err
+	}
+	result.Digest = sha256Digest(content)
+
+	block, _ := clearsign.Decode(provenance)
+	if block == nil {
+		result.Status = verificationFailed
+		result.Message = fmt.Sprintf("%s.prov is not a signed provenance file", filepath.Base(chartPackage))
+		return result, nil
+	}
+	signer, err := openpgp.CheckDetachedSignature(keys, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body, nil)
+	if err != nil {
+		result.Status = verificationFailed
+		result.Message = fmt.Sprintf("invalid signature of %s.prov: %v", filepath.Base(chartPackage), err)
+		return result, nil
+	}
+	result.SignedBy = identityName(signer)
+	result.Fingerprint = strings.ToUpper(hex.EncodeToString(signer.PrimaryKey.Fingerprint[:]))
+
+	// the provenance file consists of the Chart.yaml and the digests of the files, separated by a YAML document end
+	sums := struct {
+		Files map[string]string `yaml:"files"`
+	}{}
+	parts := strings.SplitN(string(block.Plaintext), "\n...\n", 2)
+	if len(parts) == 2 {
+		_ = yaml.Unmarshal([]byte(parts[1]), &sums)
+	}
+	if sums.Files[filepath.Base(chartPackage)] != result.Digest {
+		result.Status = verificationFailed
+		result.Message = fmt.Sprintf("digest %s of %s does not match the provenance file", result.Digest, filepath.Base(chartPackage))
+		return result, nil
+	}
+	result.Status = verificationVerified
+	return result, nil
+}
+
+// readKeyring reads a binary or ASCII armored PGP keyring.
+func readKeyring(file string) (openpgp.EntityList, error) {
+	content, err := afero.ReadFile(fs, file)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := openpgp.ReadKeyRing(bytes.NewReader(content))
+	if err != nil {
+		keys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyring %s: %v", file, err)
+	}
+	return keys, nil
+}
+
+func identityName(entity *openpgp.Entity) string {
+	var names []string
+	for name := range entity.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// verifyCosignSignature verifies the signature cosign stores as tag sha256-<digest>.sig next to the chart in the
+// registry. The manifest of the chart has to reference the fetched chart package.
+func verifyCosignSignature(ctx context.Context, chartPackage string, chart *HelmChart, config Repository, publicKeyFile string) (*verificationResult, error) {
+	if publicKeyFile == "" {
+		return nil, fmt.Errorf("verification of OCI chart %s requires a public key", chart.Chart)
+	}
+	publicKey, err := readPublicKey(publicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &verificationResult{Key: publicKeyFile}
+	ref := ociReference(chart.Repository, chart.Chart)
+	credentials, err := ociCredentials(config)
+	if err != nil {
+		return nil, err
+	}
+
+	tag, err := resolveOCITag(ctx, ref, chart.Version, credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve chart %s version %s: %v", chart.Chart, chart.Version, err)
+	}
+	manifest, err := registryContent(ctx, fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repository, tag), ref, credentials)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest of chart %s: %v", chart.Chart, err)
+	}
+	result.Digest = sha256Digest(manifest)
+
+	content, err := afero.ReadFile(fs, chartPackage)
+	if err != nil {
+		return nil, err
+	}
+	if !referencesLayer(manifest, helmChartLayerType, sha256Digest(content)) {
+		result.Status = verificationFailed
+		result.Message = fmt.Sprintf("%s does not match the chart manifest %s", filepath.Base(chartPackage), result.Digest)
+		return result, nil
+	}
+
+	signatureTag := strings.Replace(result.Digest, ":", "-", 1) + ".sig"
+	signatures, err := registryContent(ctx, fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.Registry, ref.Repository, signatureTag), ref, credentials)
+	var statusError *httpStatusError
+	if errors.As(err, &statusError) && statusError.StatusCode == http.StatusNotFound {
+		result.Status = verificationUnsigned
+		result.Message = fmt.Sprintf("no signature found for %s", result.Digest)
+		return result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signatures of chart %s: %v", chart.Chart, err)
+	}
+
+	signatureManifest := ociManifest{}
+	err = json.Unmarshal(signatures, &signatureManifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature manifest of chart %s: %v", chart.Chart, err)
+	}
+	for _, layer := range signatureManifest.Layers {
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(signature) == 0 {
+			continue
+		}
+		payload, err := registryContent(ctx, fmt.Sprintf("https://%s/v2/%s/blobs/%s", ref.Registry, ref.Repository, layer.Digest), ref, credentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signature of chart %s: %v", chart.Chart, err)
+		}
+		if sha256Digest(payload) != layer.Digest || !verifySignature(publicKey, payload, signature) {
+			continue
+		}
+		signed := cosignPayload{}
+		if json.Unmarshal(payload, &signed) != nil || signed.Critical.Image.DockerManifestDigest != result.Digest {
+			continue
+		}
+		result.Status = verificationVerified
+		return result, nil
+	}
+	result.Status = verificationFailed
+	result.Message = fmt.Sprintf("no signature of %s matches the public key %s", result.Digest, publicKeyFile)
+	return result, nil
+}
+
+// checkChartDigest compares the sha256 digest of the chart package with the digest pinned in the spec.
+func checkChartDigest(chartPackage, expected string) error {
+	content, err := afero.ReadFile(fs, chartPackage)
+	if err != nil {
+		return err
+	}
+	actual := sha256Digest(content)
+	if actual != strings.ToLower(expected) {
+		return fmt.Errorf("digest of chart package %s does not match: expected %s, got %s", filepath.Base(chartPackage), expected, actual)
+	}
+	return nil
+}
+
+func referencesLayer(manifest []byte, mediaType, digest string) bool {
+	parsed := ociManifest{}
+	if json.Unmarshal(manifest, &parsed) != nil {
+		return false
+	}
+	for _, layer := range parsed.Layers {
+		if layer.MediaType == mediaType && layer.Digest == digest {
+			return true
+		}
+	}
+	return false
+}
+
+func readPublicKey(file string) (crypto.PublicKey, error) {
+	content, err := afero.ReadFile(fs, file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded public key found in %s", file)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in %s: %v", file, err)
+	}
+	return publicKey, nil
+}
+
+// verifySignature checks a signature as created by cosign, ECDSA and RSA keys sign the SHA-256 hash of the payload.
+func verifySignature(publicKey crypto.PublicKey, payload, signature []byte) bool {
+	hash := sha256.Sum256(payload)
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, hash[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, payload, signature)
+	}
+	return false
+}
+
+func sha256Digest(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
@@ -0,0 +1,269 @@
+package helmt
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_mergeVerification(t *testing.T) {
+	require.NoError(t, MergeConfigFile("testdata/helmt-config.yaml"))
+	defer viper.Reset()
+
+	merged, err := mergeVerification(Verification{Mode: "warn"})
+	require.NoError(t, err)
+	assert.Equal(t, Verification{Mode: "warn", Keyring: "testdata/keys/pubring.gpg", PublicKey: "testdata/keys/cosign.pub"}, merged)
+
+	merged, err = mergeVerification(Verification{PublicKey: "cosign.pub"})
+	require.NoError(t, err)
+	assert.Equal(t, Verification{Mode: "off", Keyring: "testdata/keys/pubring.gpg", PublicKey: "cosign.pub"}, merged)
+
+	_, err = mergeVerification(Verification{Mode: "strict"})
+	assert.Error(t, err)
+}
+
+func signProvenance(t *testing.T, entity *openpgp.Entity, chartFile string, chartPackage []byte) []byte {
+	provenance := &bytes.Buffer{}
+	writer, err := clearsign.Encode(provenance, entity.PrivateKey, nil)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(writer, "apiVersion: v2\nname: jenkins\nversion: 2.0.0\n\n...\nfiles:\n  %s: %s\n", chartFile, sha256Digest(chartPackage))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return provenance.Bytes()
+}
+
+func Test_verifyProvenance(t *testing.T) {
+	entity, err := openpgp.NewEntity("Jenkins Maintainers", "", "jenkins@example.com", nil)
+	require.NoError(t, err)
+	otherEntity, err := openpgp.NewEntity("Someone Else", "", "someone@example.com", nil)
+	require.NoError(t, err)
+	keyring := "/keys/pubring.gpg"
+	serialized := &bytes.Buffer{}
+	require.NoError(t, entity.Serialize(serialized))
+	fingerprint := strings.ToUpper(fmt.Sprintf("%x", entity.PrimaryKey.Fingerprint))
+
+	chart := &HelmChart{Chart: "jenkins", Version: "2.0.0", Repository: "https://charts.example.com"}
+	tests := []struct {
+		name       string
+		mode       string
+		provenance []byte
+		fetched    string
+		want       *verificationResult
+		wantErr    string
+	}{
+		{
+			name:       "verified",
+			mode:       "enforce",
+			provenance: signProvenance(t, entity, "jenkins-2.0.0.tgz", []byte("chart")),
+			fetched:    "chart",
+			want: &verificationResult{
+				Mode:        "enforce",
+				Status:      "verified",
+				Key:         keyring,
+				SignedBy:    "Jenkins Maintainers <jenkins@example.com>",
+				Fingerprint: fingerprint,
+				Digest:      sha256Digest([]byte("chart")),
+			},
+		},
+		{
+			name:    "unsigned",
+			mode:    "enforce",
+			fetched: "chart",
+			wantErr: "verification of chart jenkins 2.0.0 failed: no provenance file found for jenkins-2.0.0.tgz",
+		},
+		{
+			name:       "tampered",
+			mode:       "enforce",
+			provenance: signProvenance(t, entity, "jenkins-2.0.0.tgz", []byte("chart")),
+			fetched:    "tampered",
+			wantErr:    fmt.Sprintf("verification of chart jenkins 2.0.0 failed: digest %s of jenkins-2.0.0.tgz does not match the provenance file", sha256Digest([]byte("tampered"))),
+		},
+		{
+			name:       "unknown key",
+			mode:       "enforce",
+			provenance: signProvenance(t, otherEntity, "jenkins-2.0.0.tgz", []byte("chart")),
+			fetched:    "chart",
+			wantErr:    "verification of chart jenkins 2.0.0 failed: invalid signature of jenkins-2.0.0.tgz.prov: openpgp: signature made by unknown entity",
+		},
+		{
+			name:    "unsigned with warning",
+			mode:    "warn",
+			fetched: "chart",
+			want:    &verificationResult{Mode: "warn", Status: "unsigned", Key: keyring, Message: "no provenance file found for jenkins-2.0.0.tgz"},
+		},
+		{
+			name:       "tampered with warning",
+			mode:       "warn",
+			provenance: signProvenance(t, entity, "jenkins-2.0.0.tgz", []byte("chart")),
+			fetched:    "tampered",
+			want: &verificationResult{
+				Mode:        "warn",
+				Status:      "failed",
+				Key:         keyring,
+				SignedBy:    "Jenkins Maintainers <jenkins@example.com>",
+				Fingerprint: fingerprint,
+				Digest:      sha256Digest([]byte("tampered")),
+				Message:     fmt.Sprintf("digest %s of jenkins-2.0.0.tgz does not match the provenance file", sha256Digest([]byte("tampered"))),
+			},
+		},
+		{
+			name: "off",
+			mode: "off",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs = afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(fs, keyring, serialized.Bytes(), 0644))
+			require.NoError(t, afero.WriteFile(fs, "/temp/helmt-123/jenkins-2.0.0.tgz", []byte(tt.fetched), os.ModePerm))
+			if tt.provenance != nil {
+				require.NoError(t, afero.WriteFile(fs, "/temp/helmt-123/jenkins-2.0.0.tgz.prov", tt.provenance, os.ModePerm))
+			}
+
+			result, err := verifyChartCommand(context.Background(), "/temp/helmt-123", "jenkins-2.0.0.tgz", chart, Repository{}, Verification{Mode: tt.mode, Keyring: keyring})
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, result)
+		})
+	}
+}
+
+// newTestChartRegistry serves the manifest of charts/jenkins:2.0.0 referencing chartPackage and, if signed, a cosign
+// signature created with key.
+func newTestChartRegistry(t *testing.T, chartPackage []byte, key *ecdsa.PrivateKey, signed bool) *httptest.Server {
+	content := map[string][]byte{}
+	manifest, err := json.Marshal(ociManifest{Layers: []ociDescriptor{{MediaType: helmChartLayerType, Digest: sha256Digest(chartPackage)}}})
+	require.NoError(t, err)
+	content["/v2/charts/jenkins/manifests/2.0.0"] = manifest
+
+	if signed {
+		payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"charts/jenkins"},"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":null}`, sha256Digest(manifest)))
+		hash := sha256.Sum256(payload)
+		signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+		require.NoError(t, err)
+		signatures, err := json.Marshal(ociManifest{Layers: []ociDescriptor{{
+			MediaType:   "application/vnd.dev.cosign.simplesigning.v1+json",
+			Digest:      sha256Digest(payload),
+			Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+		}}})
+		require.NoError(t, err)
+		content["/v2/charts/jenkins/manifests/"+strings.Replace(sha256Digest(manifest), ":", "-", 1)+".sig"] = signatures
+		content["/v2/charts/jenkins/blobs/"+sha256Digest(payload)] = payload
+	}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := content[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	registryClient = server.Client()
+	return server
+}
+
+func writePublicKey(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	file := "/keys/cosign.pub"
+	require.NoError(t, afero.WriteFile(fs, file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+	return file
+}
+
+func Test_verifyCosignSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		signed        bool
+		signingKey    *ecdsa.PrivateKey
+		fetched       string
+		wantStatus    string
+		wantMessage   string
+		wantErrSuffix string
+	}{
+		{name: "verified", signed: true, signingKey: key, fetched: "chart", wantStatus: "verified"},
+		{name: "unsigned", signingKey: key, fetched: "chart", wantStatus: "unsigned", wantMessage: "no signature found for sha256:"},
+		{name: "tampered chart", signed: true, signingKey: key, fetched: "tampered", wantStatus: "failed", wantMessage: "chart-1.0.0.tgz does not match the chart manifest sha256:"},
+		{name: "other key", signed: true, signingKey: otherKey, fetched: "chart", wantStatus: "failed", wantMessage: "no signature of sha256:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestChartRegistry(t, []byte("chart"), tt.signingKey, tt.signed)
+			defer server.Close()
+			fs = afero.NewMemMapFs()
+			publicKey := writePublicKey(t, key)
+			require.NoError(t, afero.WriteFile(fs, "/temp/helmt-123/chart-1.0.0.tgz", []byte(tt.fetched), os.ModePerm))
+			chart := &HelmChart{Chart: "jenkins", Version: "2.0.0", Repository: "oci://" + strings.TrimPrefix(server.URL, "https://") + "/charts"}
+
+			result, err := verifyChartCommand(context.Background(), "/temp/helmt-123", "chart-1.0.0.tgz", chart, Repository{}, Verification{Mode: "warn", PublicKey: publicKey})
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, result.Status)
+			assert.Equal(t, publicKey, result.Key)
+			assert.True(t, strings.HasPrefix(result.Message, tt.wantMessage), result.Message)
+			assert.True(t, strings.HasPrefix(result.Digest, "sha256:"))
+
+			_, err = verifyChartCommand(context.Background(), "/temp/helmt-123", "chart-1.0.0.tgz", chart, Repository{}, Verification{Mode: "enforce", PublicKey: publicKey})
+			assert.Equal(t, tt.wantStatus != "verified", err != nil)
+		})
+	}
+
+	_, err = verifyChartCommand(context.Background(), "/temp/helmt-123", "chart-1.0.0.tgz", &HelmChart{Chart: "jenkins", Repository: "oci://registry.example.com"}, Repository{}, Verification{Mode: "enforce"})
+	assert.EqualError(t, err, "verification of OCI chart jenkins requires a public key")
+}
+
+func Test_checkChartDigest(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/temp/helmt-123/chart-1.0.0.tgz", []byte("chart"), os.ModePerm))
+
+	assert.NoError(t, checkChartDigest("/temp/helmt-123/chart-1.0.0.tgz", "sha256:cc57fc1903e444cf6a726490b43b27ee9f87facc037f86872201847c565b45fb"))
+
+	err := checkChartDigest("/temp/helmt-123/chart-1.0.0.tgz", "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	assert.EqualError(t, err, "digest of chart package chart-1.0.0.tgz does not match: expected sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855, got sha256:cc57fc1903e444cf6a726490b43b27ee9f87facc037f86872201847c565b45fb")
+}
+
+func TestHelmTemplateFailsVerificationBeforeTemplate(t *testing.T) {
+	executor := NewTestExecutor(t)
+	execute = executor.execCommand
+	verifyChart = verifyChartCommand
+	fs = afero.NewMemMapFs()
+	require.NoError(t, fs.Mkdir("/temp/helmt-123", os.ModePerm))
+	TempDir = func(fs afero.Fs, dir, prefix string) (name string, err error) {
+		return "/temp/helmt-123", nil
+	}
+	fetch = func(ctx context.Context, tmpDir, repository, chart, version string, config Repository, provenance bool) (string, error) {
+		assert.True(t, provenance)
+		return "chart-1.0.0.tgz", afero.WriteFile(fs, "/temp/helmt-123/chart-1.0.0.tgz", nil, os.ModePerm)
+	}
+
+	err := HelmTemplate(context.Background(), "testdata/helm-chart-verify.yaml", "", "")
+	assert.EqualError(t, err, "verification of chart jenkins 2.0.0 failed: no provenance file found for chart-1.0.0.tgz")
+	assert.Equal(t, []string{"helm version"}, executor.commands)
+}